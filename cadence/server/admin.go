@@ -0,0 +1,448 @@
+// admin.go
+// Authenticated station control under /api/admin/.
+//
+// Administrators authenticate with the bearer token CSERVER_ADMIN_TOKEN, or with HTTP basic auth
+// using any username and a password matching the bcrypt hash CSERVER_ADMIN_PASSWORDHASH.
+// Every action is written to the audit log.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kenellorando/clog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bansTableName = "banned_songs"
+const auditTableName = "audit_log"
+
+var errSongBanned = errors.New("song is banned")
+
+type adminContextKey struct{}
+
+type Ban struct {
+	Song     SongData
+	Reason   string
+	BannedAt time.Time
+	BannedBy string
+}
+
+type AuditEntry struct {
+	ID      int
+	At      time.Time
+	Actor   string
+	Action  string
+	Detail  string
+	Status  int
+	Station string
+}
+
+// Reports whether any admin credentials are configured. Without them the admin API is not served.
+func (s *Server) adminEnabled() bool {
+	return s.Config.AdminToken != "" || s.Config.AdminPasswordHash != ""
+}
+
+// Checks a request's credentials. Returns a description of who made the request for the audit log.
+func (s *Server) adminAuthenticate(r *http.Request) (actor string, ok bool) {
+	ip, _ := checkIP(r)
+	auth := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(auth, "Bearer "); found && s.Config.AdminToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) == 1 {
+			return "token@" + ip, true
+		}
+		return "", false
+	}
+	if user, password, found := r.BasicAuth(); found && s.Config.AdminPasswordHash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(s.Config.AdminPasswordHash), []byte(password)) == nil {
+			return user + "@" + ip, true
+		}
+	}
+	return "", false
+}
+
+// Wraps admin handlers with authentication and audit logging. GET requests are served by view,
+// POST requests by action and recorded in the audit log. Either may be nil if the route does not support it.
+func (s *Server) adminAuth(st *Station, view http.Handler, action http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := s.adminAuthenticate(r)
+		if !ok {
+			clog.Warn("adminAuth", fmt.Sprintf("Rejected unauthenticated admin request from client %s to <%s>.", r.RemoteAddr, r.URL.Path))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cadence", Basic realm="cadence"`)
+			w.WriteHeader(http.StatusUnauthorized) // 401 Unauthorized
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), adminContextKey{}, actor))
+		if r.Method == http.MethodGet && view != nil {
+			view.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodPost || action == nil {
+			w.WriteHeader(http.StatusMethodNotAllowed) // 405 Method Not Allowed
+			return
+		}
+		// Keep a copy of the body for the audit log.
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			clog.Error("adminAuth", "Unable to read admin request body.", err)
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		action.ServeHTTP(sw, r)
+		stationName := ""
+		if st != nil {
+			stationName = st.Name
+		}
+		s.audit(actor, r.URL.Path, stationName, string(body), sw.status)
+	})
+}
+
+// Writes an admin action to the audit log.
+func (s *Server) audit(actor string, action string, station string, detail string, status int) {
+	clog.Info("audit", fmt.Sprintf("Admin <%s> performed <%s> on station <%s> with <%s>, result <%d>.", actor, action, station, detail, status))
+	if s.DB == nil {
+		return
+	}
+	_, err := s.DB.Exec(fmt.Sprintf("INSERT INTO %s (actor, action, station, detail, status) VALUES ($1, $2, $3, $4, $5)", auditTableName),
+		actor, action, station, detail, status)
+	if err != nil {
+		clog.Error("audit", "Failed to write the audit log.", err)
+	}
+}
+
+// Returns the most recent audit log entries, newest first.
+func (s *Server) auditList(limit int) (entries []AuditEntry, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf("SELECT id, at, actor, action, station, detail, status FROM %s ORDER BY id DESC LIMIT $1", auditTableName), limit)
+	if err != nil {
+		clog.Error("auditList", "Failed to read the audit log.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	entries = []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Station, &e.Detail, &e.Status)
+		if err != nil {
+			clog.Error("auditList", "Data scan failed.", err)
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Bans a song from being requested or found in search.
+// Bans a song, or updates the reason for its ban. Returns errNotFound if the song is not in the library.
+func (s *Server) banSong(songID int, reason string, actor string) error {
+	result, err := s.DB.Exec(fmt.Sprintf(`INSERT INTO %s (song_id, reason, banned_by) SELECT id, $2, $3 FROM %s WHERE id = $1
+	ON CONFLICT (song_id) DO UPDATE SET reason = EXCLUDED.reason, banned_by = EXCLUDED.banned_by, banned_at = now()`,
+		bansTableName, s.Config.PostgresTableName), songID, reason, actor)
+	if err != nil {
+		clog.Error("banSong", fmt.Sprintf("Failed to ban song <%d>.", songID), err)
+		return err
+	}
+	if banned, err := result.RowsAffected(); err == nil && banned == 0 {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *Server) unbanSong(songID int) error {
+	_, err := s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE song_id = $1", bansTableName), songID)
+	if err != nil {
+		clog.Error("unbanSong", fmt.Sprintf("Failed to unban song <%d>.", songID), err)
+	}
+	return err
+}
+
+// Reports whether a song is banned.
+func (s *Server) songBanned(songID int) (banned bool, err error) {
+	err = s.DB.QueryRow(fmt.Sprintf("SELECT true FROM %s WHERE song_id = $1", bansTableName), songID).Scan(&banned)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return banned, err
+}
+
+func (s *Server) banList() (bans []Ban, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT b.song_id, %s, b.reason, b.banned_at, b.banned_by
+	FROM %s b LEFT JOIN %s m ON m.id = b.song_id ORDER BY b.banned_at DESC`, songColumns, bansTableName, s.Config.PostgresTableName))
+	if err != nil {
+		clog.Error("banList", "Failed to read banned songs.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	bans = []Ban{}
+	for rows.Next() {
+		var b Ban
+		targets := append([]interface{}{&b.Song.ID}, songScanTargets(&b.Song)...)
+		err = rows.Scan(append(targets, &b.Reason, &b.BannedAt, &b.BannedBy)...)
+		if err != nil {
+			clog.Error("banList", "Data scan failed.", err)
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// Returns who is making an authenticated admin request.
+func adminActor(r *http.Request) string {
+	actor, _ := r.Context().Value(adminContextKey{}).(string)
+	return actor
+}
+
+// Decodes a JSON request body, writing 400 Bad Request if it cannot be decoded.
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, caller string, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		clog.Error(caller, "Unable to decode admin request body.", err)
+		w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+		return false
+	}
+	return true
+}
+
+// Writes a value as a JSON response.
+func writeAdminJSON(w http.ResponseWriter, caller string, v interface{}) {
+	jsonMarshal, err := json.Marshal(v)
+	if err != nil {
+		clog.Error(caller, "Failed to marshal response.", err)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonMarshal)
+	if err != nil {
+		clog.Error(caller, "Failed to write response.", err)
+		return
+	}
+}
+
+// POST /api/admin/{station}/skip
+// Skips the track the station is playing.
+func (s *Server) AdminSkip(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := st.Liquidsoap.Skip(st.Output)
+		if err != nil {
+			clog.Error("AdminSkip", "Unable to skip the playing song.", err)
+			w.WriteHeader(http.StatusBadGateway) // 502 Bad Gateway
+			return
+		}
+		w.WriteHeader(http.StatusOK) // 200 OK
+	}
+}
+
+// POST /api/admin/{station}/queue/clear
+// Cancels every request which has not been sent to Liquidsoap yet.
+func (s *Server) AdminQueueClear(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cleared, err := s.requestQueueClear(st)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		type Cleared struct {
+			Cleared int
+		}
+		writeAdminJSON(w, "AdminQueueClear", Cleared{Cleared: cleared})
+	}
+}
+
+// POST /api/admin/{station}/queue/cancel
+// Receives the ID of a request queue entry and cancels it, if it has not been sent to Liquidsoap yet.
+func (s *Server) AdminQueueCancel(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type Cancel struct {
+			ID int
+		}
+		var cancel Cancel
+		if !decodeAdminBody(w, r, "AdminQueueCancel", &cancel) {
+			return
+		}
+		writeQueueChangeStatus(w, "AdminQueueCancel", s.requestQueueCancel(st, cancel.ID))
+	}
+}
+
+// POST /api/admin/{station}/queue/move
+// Receives the ID of a request queue entry and the 1-based position to move it to among the waiting requests.
+func (s *Server) AdminQueueMove(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type Move struct {
+			ID       int
+			Position int
+		}
+		var move Move
+		if !decodeAdminBody(w, r, "AdminQueueMove", &move) {
+			return
+		}
+		writeQueueChangeStatus(w, "AdminQueueMove", s.requestQueueMove(st, move.ID, move.Position))
+	}
+}
+
+func writeQueueChangeStatus(w http.ResponseWriter, caller string, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK) // 200 OK
+	case errQueueEntryNotFound:
+		w.WriteHeader(http.StatusNotFound) // 404 Not Found
+	case errQueueEntryNotQueued:
+		w.WriteHeader(http.StatusConflict) // 409 Conflict
+	default:
+		clog.Error(caller, "Unable to change the request queue.", err)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+	}
+}
+
+// POST /api/admin/rescan
+// Starts a scan of the music library in the background.
+func (s *Server) AdminRescan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		go func() {
+			err := s.postgresPopulate()
+			if err != nil {
+				clog.Error("AdminRescan", "Library rescan failed.", err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted) // 202 Accepted
+	}
+}
+
+// POST /api/admin/reindex
+// Starts reading the tags of every song in the library again, in the background. Song IDs,
+// and the requests, bans and history which refer to them, are kept.
+func (s *Server) AdminReindex() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		go func() {
+			err := s.postgresReindex()
+			if err != nil {
+				clog.Error("AdminReindex", "Library reindex failed.", err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted) // 202 Accepted
+	}
+}
+
+// GET /api/admin/bans
+// Gets the banned songs, most recently banned first.
+func (s *Server) AdminBans() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bans, err := s.banList()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		writeAdminJSON(w, "AdminBans", bans)
+	}
+}
+
+// POST /api/admin/ban
+// Receives the ID of a song and a reason. The song can no longer be requested or found in search.
+// Gets 404 Not Found if the song is not in the library.
+func (s *Server) AdminBan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type Ban struct {
+			ID     int
+			Reason string
+		}
+		var ban Ban
+		if !decodeAdminBody(w, r, "AdminBan", &ban) {
+			return
+		}
+		err := s.banSong(ban.ID, ban.Reason, adminActor(r))
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound) // 404 Not Found
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.WriteHeader(http.StatusOK) // 200 OK
+	}
+}
+
+// POST /api/admin/unban
+// Receives the ID of a banned song and lifts the ban.
+func (s *Server) AdminUnban() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type Unban struct {
+			ID int
+		}
+		var unban Unban
+		if !decodeAdminBody(w, r, "AdminUnban", &unban) {
+			return
+		}
+		if s.unbanSong(unban.ID) != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.WriteHeader(http.StatusOK) // 200 OK
+	}
+}
+
+// GET, POST /api/admin/ratelimit
+// Gets or sets the period of the song request rate limit in seconds. Setting a period keeps the
+// policy's algorithm and limit, or allows one request per period if requests were not limited.
+// Zero removes the limit.
+func (s *Server) AdminRateLimit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RateLimit struct {
+			RequestRateLimit int
+		}
+		if r.Method == http.MethodPost {
+			var limit RateLimit
+			if !decodeAdminBody(w, r, "AdminRateLimit", &limit) {
+				return
+			}
+			if limit.RequestRateLimit < 0 {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+			policy, ok := s.rateLimitPolicy("request")
+			if !ok {
+				policy = RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 1}
+			}
+			policy.Period = time.Duration(limit.RequestRateLimit) * time.Second
+			s.setRateLimitPolicy("request", policy)
+			clog.Info("AdminRateLimit", fmt.Sprintf("Request rate limit period set to <%d> seconds.", limit.RequestRateLimit))
+		}
+		policy, _ := s.rateLimitPolicy("request")
+		writeAdminJSON(w, "AdminRateLimit", RateLimit{RequestRateLimit: int(policy.Period / time.Second)})
+	}
+}
+
+// GET /api/admin/audit?limit=
+// Gets the most recent admin actions, newest first. Returns 100 entries unless a limit is given.
+func (s *Server) AdminAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 1 {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+		}
+		entries, err := s.auditList(limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		writeAdminJSON(w, "AdminAudit", entries)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminAuth(t *testing.T) {
+	s, fakeLS, _ := newTestServer(t)
+	s.Config.AdminToken = "secret"
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Config.AdminPasswordHash = string(hash)
+	routes := s.routes()
+
+	for _, tc := range []struct {
+		name  string
+		auth  func(*http.Request)
+		want  int
+		skips int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized, 0},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized, 0},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized, 0},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK, 1},
+		{"password", func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, http.StatusOK, 2},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/cadence1/skip", nil)
+		tc.auth(req)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: skip returned %d, want %d", tc.name, rec.Code, tc.want)
+		}
+		if got := len(fakeLS.Commands()); got != tc.skips {
+			t.Errorf("%s: fake liquidsoap received %d commands, want %d", tc.name, got, tc.skips)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/skip", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET skip returned %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminDisabledWithoutCredentials(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/skip", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("admin route returned %d without credentials configured, want 404", rec.Code)
+	}
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	s.Config.AdminToken = "secret"
+	routes := s.routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/ratelimit", strings.NewReader(`{"RequestRateLimit": 42}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setting the rate limit returned %d", rec.Code)
+	}
+	if got, _ := s.rateLimitPolicy("request"); got.Period != 42*time.Second {
+		t.Errorf("request rate limit is %v, want 42s", got.Period)
+	}
+	if body := rec.Body.String(); body != `{"RequestRateLimit":42}` {
+		t.Errorf("response was %s", body)
+	}
+}
+
+func TestAdminBan(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.AdminToken = "secret"
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "1.mp3"), "Thunderstruck", "AC/DC")
+	connectTestPostgres(t, s)
+	songs, err := s.searchByTitleArtist(s.defaultStation(), "Thunderstruck", "AC/DC")
+	if err != nil || len(songs) != 1 {
+		t.Fatalf("indexed songs are %+v, %v", songs, err)
+	}
+	routes := s.routes()
+
+	// Songs which are not in the library cannot be banned.
+	for id, want := range map[int]int{songs[0].ID: http.StatusOK, 999999: http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/ban", strings.NewReader(fmt.Sprintf(`{"ID": %d, "Reason": "test"}`, id)))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("banning song <%d> returned %d, want %d", id, rec.Code, want)
+		}
+	}
+	if bans, err := s.banList(); err != nil || len(bans) != 1 || bans[0].Song.ID != songs[0].ID {
+		t.Errorf("bans are %+v, %v", bans, err)
+	}
+}
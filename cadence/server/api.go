@@ -7,19 +7,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
-	"github.com/dhowden/tag"
 	"github.com/kenellorando/clog"
 )
 
-// POST /api/search
-// Receives a search query, which it looks in the database for.
-// Returns a JSON list of text metadata (excluding art and path) of any matching songs.
-func Search() http.HandlerFunc {
+// Returned by lookups of songs, albums and artists which are not in the library.
+var errNotFound = errors.New("not found")
+
+// POST /api/{station}/search?limit=&offset=
+// Receives a search query, which it looks in the database for. See search.go for the query syntax.
+// Returns a JSON list of text metadata (excluding art and path) of matching songs, most relevant first.
+// Results are paged: limit defaults to 50 and may be at most 200. The X-Total-Count header holds the number of matches.
+func (s *Server) Search(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		clog.Debug("Search", fmt.Sprintf("Search request from client %s.", r.RemoteAddr))
 		type Search struct {
@@ -33,12 +38,23 @@ func Search() http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
 			return
 		}
-		queryResults, err := searchByQuery(search.Query)
+		limit, offset, err := parsePage(r, searchDefaultLimit, searchMaxLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		queryResults, total, err := s.searchByQuery(st, search.Query, limit, offset)
+		if errors.Is(err, errInvalidSearch) {
+			clog.Debug("Search", fmt.Sprintf("Rejected search: %v", err))
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
 		if err != nil {
 			clog.Error("Search", "Unable to execute search by query.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 		jsonMarshal, err := json.Marshal(queryResults)
 		if err != nil {
 			clog.Error("Search", "Failed to marshal results from the search.", err)
@@ -54,10 +70,10 @@ func Search() http.HandlerFunc {
 	}
 }
 
-// POST /api/request/id
+// POST /api/{station}/request/id
 // Receives an integer ID of a song to request.
 // This ID is translated to a filesystem path, which is passed to Liquidsoap for processing.
-func RequestID() http.HandlerFunc {
+func (s *Server) RequestID(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		clog.Info("Request", fmt.Sprintf("Request-by-ID by client %s.", r.RemoteAddr))
 		type Request struct {
@@ -77,26 +93,14 @@ func RequestID() http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		path, err := getPathById(reqID)
-		if err != nil {
-			clog.Error("RequestID", "Unable to find file path by song ID.", err)
-			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
-			return
-		}
-		_, err = liquidsoapRequest(path)
-		if err != nil {
-			clog.Error("RequestID", "Unable to submit song request.", err)
-			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
-			return
-		}
-		w.WriteHeader(http.StatusAccepted) // 202 Accepted
+		s.writeQueuedRequest(st, w, r, "RequestID", reqID)
 	}
 }
 
-// POST /api/request/bestmatch
+// POST /api/{station}/request/bestmatch
 // Receives a search query, which it looks in the database for.
 // The number one result of the search has its path taken and submitted to Liquidsoap for processing.
-func RequestBestMatch() http.HandlerFunc {
+func (s *Server) RequestBestMatch(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		clog.Debug("Search", fmt.Sprintf("Decoding http-request data from client %s.", r.RemoteAddr))
 		type RequestBestMatch struct {
@@ -110,44 +114,148 @@ func RequestBestMatch() http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
 			return
 		}
-		queryResults, err := searchByQuery(rbm.Query)
+		queryResults, _, err := s.searchByQuery(st, rbm.Query, 1, 0)
+		if errors.Is(err, errInvalidSearch) {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
 		if err != nil {
 			clog.Error("RequestBestMatch", "Unable to search by query.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		path, err := getPathById(queryResults[0].ID)
-		if err != nil {
-			clog.Error("RequestBestMatch", "Unable to find file path by song ID", err)
-			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		if len(queryResults) < 1 {
+			clog.Debug("RequestBestMatch", "No songs matched the request query.")
+			w.WriteHeader(http.StatusNotFound) // 404 Not Found
 			return
 		}
-		_, err = liquidsoapRequest(path)
+		s.writeQueuedRequest(st, w, r, "RequestBestMatch", queryResults[0].ID)
+	}
+}
+
+// Reads the limit and offset query parameters of a paged request.
+// limit defaults to defaultLimit and is capped at maxLimit.
+func parsePage(r *http.Request, defaultLimit int, maxLimit int) (limit int, offset int, err error) {
+	limit = defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit <%s>", v)
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset <%s>", v)
+		}
+	}
+	return limit, offset, nil
+}
+
+// Returns the number of rows a query gives. Paged queries read their total from COUNT(*) OVER (),
+// which has no row to appear on when the offset is past the last one, so they count them here instead.
+func (s *Server) countRows(query string, args ...interface{}) (total int, err error) {
+	err = s.DB.QueryRow("SELECT COUNT(*) FROM ("+query+") counted", args...).Scan(&total)
+	return total, err
+}
+
+// Adds a song to the request queue on behalf of the client and writes the new queue entry.
+func (s *Server) writeQueuedRequest(st *Station, w http.ResponseWriter, r *http.Request, caller string, songID int) {
+	ip, err := checkIP(r)
+	if err != nil {
+		clog.Error(caller, "Unable to determine the requesting client's address.", err)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		return
+	}
+	entry, err := s.requestQueueAdd(st, songID, ip)
+	if err == errNotFound {
+		clog.Debug(caller, fmt.Sprintf("Requested song <%d> does not exist.", songID))
+		w.WriteHeader(http.StatusNotFound) // 404 Not Found
+		return
+	}
+	if err == errSongBanned {
+		clog.Debug(caller, fmt.Sprintf("Requested song <%d> is banned.", songID))
+		w.WriteHeader(http.StatusForbidden) // 403 Forbidden
+		return
+	}
+	var rejection RequestRejection
+	if errors.As(err, &rejection) {
+		clog.Debug(caller, fmt.Sprintf("Request for song <%d> was rejected: %s", songID, rejection.Reason))
+		jsonMarshal, err := json.Marshal(rejection)
 		if err != nil {
-			clog.Error("RequestBestMatch", "Unable to submit song request.", err)
+			clog.Error(caller, "Failed to marshal request rejection.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		w.WriteHeader(http.StatusAccepted) // 202 Accepted
+		w.Header().Set("Content-Type", "application/json")
+		if rejection.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(rejection.RetryAfter))
+		}
+		w.WriteHeader(http.StatusConflict) // 409 Conflict
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error(caller, "Failed to write response.", err)
+		}
+		return
+	}
+	if err != nil {
+		clog.Error(caller, "Unable to submit song request.", err)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		return
+	}
+	jsonMarshal, err := json.Marshal(entry)
+	if err != nil {
+		clog.Error(caller, "Failed to marshal request queue entry.", err)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted) // 202 Accepted
+	_, err = w.Write(jsonMarshal)
+	if err != nil {
+		clog.Error(caller, "Failed to write response.", err)
+		return
 	}
 }
 
-// /api/nowplaying/metadata
-// Gets text metadata (excludes album art and path) of the currently playing song.
-func NowPlayingMetadata() http.HandlerFunc {
+// GET /api/{station}/request/queue
+// Gets the song requests which have not finished playing, in the order they will play.
+func (s *Server) RequestQueue(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		queryResults, err := searchByTitleArtist(now.Song.Title, now.Song.Artist)
+		entries, err := s.requestQueueList(st)
 		if err != nil {
-			clog.Error("NowPlayingMetadata", "Unable to search by title and artist.", err)
+			clog.Error("RequestQueue", "Unable to list the request queue.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		if len(queryResults) < 1 {
-			clog.Warn("NowPlayingMetadata", "The currently playing song could not be found in the database. The database may not be populated.")
+		jsonMarshal, err := json.Marshal(entries)
+		if err != nil {
+			clog.Error("RequestQueue", "Failed to marshal request queue.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error("RequestQueue", "Failed to write response.", err)
+			return
+		}
+	}
+}
+
+// GET /api/{station}/nowplaying/metadata
+// Gets text metadata (excludes album art and path) of the currently playing song.
+// Returns 404 Not Found while the station plays something which is not in the library.
+func (s *Server) NowPlayingMetadata(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		song := st.nowPlaying().Song
+		if song.ID == 0 {
+			clog.Debug("NowPlayingMetadata", "The currently playing song is not in the library.")
 			w.WriteHeader(http.StatusNotFound) // 404 Not Found
 			return
 		}
-		jsonMarshal, err := json.Marshal(queryResults[0])
+		jsonMarshal, err := json.Marshal(song)
 		if err != nil {
 			clog.Error("NowPlayingMetadata", "Failed to marshal results from the search.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
@@ -162,48 +270,41 @@ func NowPlayingMetadata() http.HandlerFunc {
 	}
 }
 
-// GET /api/nowplaying/albumart
+// GET /api/{station}/nowplaying/albumart
 // Gets base64 encoded album art of the currently playing song.
-func NowPlayingAlbumArt() http.HandlerFunc {
+// Kept for existing clients; /api/art/{songID} serves the image itself and can be cached.
+func (s *Server) NowPlayingAlbumArt(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		queryResults, err := searchByTitleArtist(now.Song.Title, now.Song.Artist)
-		if err != nil {
-			clog.Error("NowPlayingAlbumArt", "Unable to search by title and artist.", err)
-			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		song := st.nowPlaying().Song
+		if song.ID == 0 {
+			clog.Debug("NowPlayingAlbumArt", "The currently playing song is not in the library.")
+			w.WriteHeader(http.StatusNotFound) // 404 Not Found
 			return
 		}
-		if len(queryResults) < 1 {
-			clog.Warn("NowPlayingAlbumArt", "The currently playing song could not be found in the database. The database may not be populated.")
+		art, err := s.artCached(song.ID, 0)
+		if err == errNotFound {
 			w.WriteHeader(http.StatusNotFound) // 404 Not Found
 			return
 		}
-		path, err := getPathById(queryResults[0].ID)
-		if err != nil {
-			clog.Error("NowPlayingAlbumArt", "Unable to find file path by song ID.", err)
-			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		if err == errNoArt {
+			clog.Debug("NowPlayingAlbumArt", "The currently playing song has no album art metadata.")
+			w.WriteHeader(http.StatusNoContent) // 204 No Content
 			return
 		}
-		file, err := os.Open(path)
 		if err != nil {
-			clog.Error("NowPlayingAlbumArt", "Unable to open a file for album art extraction.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		tags, err := tag.ReadFrom(file)
+		picture, err := os.ReadFile(art.Path)
 		if err != nil {
-			clog.Error("NowPlayingAlbumArt", "Unable to read tags on file for art extraction.", err)
+			clog.Error("NowPlayingAlbumArt", "Unable to read cached art.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		if tags.Picture() == nil {
-			clog.Debug("NowPlayingAlbumArt", "The currently playing song has no album art metadata.")
-			w.WriteHeader(http.StatusNoContent) // 204 No Content
-			return
-		}
 		type SongData struct {
 			Picture []byte
 		}
-		result := SongData{Picture: tags.Picture().Data}
+		result := SongData{Picture: picture}
 		jsonMarshal, err := json.Marshal(result)
 		if err != nil {
 			clog.Error("NowPlayingAlbumArt", "Failed to marshal art data.", err)
@@ -219,11 +320,53 @@ func NowPlayingAlbumArt() http.HandlerFunc {
 	}
 }
 
-// GET /api/history
-// Gets a list of the ten last-played songs, noting the time each ended.
-func History() http.HandlerFunc {
+// GET /api/{station}/history?since=&until=&limit=&cursor=
+// Gets the songs played on the station, newest first, noting when each started and ended.
+// since and until are RFC 3339 times; only plays overlapping that span are returned.
+// limit is the page size, 20 unless given and at most 100. The NextCursor of a response
+// is passed as cursor to get the following page, and is empty on the last page.
+func (s *Server) History(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		jsonMarshal, err := json.Marshal(history)
+		query := r.URL.Query()
+		var since, until time.Time
+		var err error
+		if v := query.Get("since"); v != "" {
+			if since, err = time.Parse(time.RFC3339, v); err != nil {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+		}
+		if v := query.Get("until"); v != "" {
+			if until, err = time.Parse(time.RFC3339, v); err != nil {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+		}
+		limit := 20
+		if v := query.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+			if limit > 100 {
+				limit = 100
+			}
+		}
+		cursor := query.Get("cursor")
+		if _, err = strconv.Atoi(cursor); cursor != "" && err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		plays, next, err := s.historyList(st, since, until, limit, cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		type History struct {
+			Plays      []PlayRecord
+			NextCursor string
+		}
+		jsonMarshal, err := json.Marshal(History{Plays: plays, NextCursor: next})
 		if err != nil {
 			clog.Error("History", "Failed to marshal play history.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
@@ -238,13 +381,14 @@ func History() http.HandlerFunc {
 	}
 }
 
-// GET /api/listenurl
+// GET /api/{station}/listenurl
 // Gets the direct stream listen URL, which is a combination of host and mountpoint, set by Icecast's cadence.xml.
-func ListenURL() http.HandlerFunc {
+func (s *Server) ListenURL(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type ListenURL struct {
 			ListenURL string
 		}
+		now := st.nowPlaying()
 		listenurl := ListenURL{ListenURL: string(now.Host + "/" + now.Mountpoint)}
 		jsonMarshal, err := json.Marshal(listenurl)
 		if err != nil {
@@ -261,14 +405,14 @@ func ListenURL() http.HandlerFunc {
 	}
 }
 
-// GET /api/listeners
+// GET /api/{station}/listeners
 // Gets the number of active connections to Icecast's stream.
-func Listeners() http.HandlerFunc {
+func (s *Server) Listeners(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Listeners struct {
 			Listeners int
 		}
-		listeners := Listeners{Listeners: int(now.Listeners)}
+		listeners := Listeners{Listeners: int(st.nowPlaying().Listeners)}
 		jsonMarshal, err := json.Marshal(listeners)
 		if err != nil {
 			clog.Error("Listeners", "Failed to marshal listeners.", err)
@@ -284,14 +428,14 @@ func Listeners() http.HandlerFunc {
 	}
 }
 
-// GET /api/bitrate
+// GET /api/{station}/bitrate
 // Gets the audio stream bitrate in kilobits.
-func Bitrate() http.HandlerFunc {
+func (s *Server) Bitrate(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Bitrate struct {
 			Bitrate int
 		}
-		bitrate := Bitrate{Bitrate: int(now.Bitrate)}
+		bitrate := Bitrate{Bitrate: int(st.nowPlaying().Bitrate)}
 		jsonMarshal, err := json.Marshal(bitrate)
 		if err != nil {
 			clog.Error("Bitrate", "Failed to marshal bitrate.", err)
@@ -309,12 +453,12 @@ func Bitrate() http.HandlerFunc {
 
 // GET /api/version
 // Gets the current server version (set in cadence.env).
-func Version() http.HandlerFunc {
+func (s *Server) Version() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Version struct {
 			Version string
 		}
-		version := Version{Version: c.Version}
+		version := Version{Version: s.Config.Version}
 		jsonMarshal, err := json.Marshal(version)
 		if err != nil {
 			clog.Error("Version", "Failed to marshal version.", err)
@@ -330,25 +474,44 @@ func Version() http.HandlerFunc {
 	}
 }
 
-// GET /ready
-// Gets 200 OK status. Primarily used for verifying health/readiness of the API.
-func Ready() http.HandlerFunc {
+// GET /api/{station}/dev/skip
+// Requires development mode enabled.
+// Forwards a request to the station's Liquidsoap to skip the currently playing track.
+func (s *Server) DevSkip(st *Station) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := st.Liquidsoap.Skip(st.Output)
+		if err != nil {
+			clog.Error("DevSkip", "Unable to skip the playing song.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
 		w.WriteHeader(http.StatusOK) // 200 OK
 	}
 }
 
-// GET /api/dev/skip
-// Requires development mode enabled.
-// Forwards a request to Liquidsoap to skip the currently playing track.
-func DevSkip() http.HandlerFunc {
+// GET /api/stations
+// Gets the names of the stations this server runs. The first is served by the unscoped /api/... routes.
+func (s *Server) StationList() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := liquidsoapSkip()
+		type Stations struct {
+			Stations []string
+			Default  string
+		}
+		stations := Stations{Default: s.defaultStation().Name}
+		for _, st := range s.Stations {
+			stations.Stations = append(stations.Stations, st.Name)
+		}
+		jsonMarshal, err := json.Marshal(stations)
 		if err != nil {
-			clog.Error("DevSkip", "Unable to skip the playing song.", err)
+			clog.Error("StationList", "Failed to marshal stations.", err)
 			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
 			return
 		}
-		w.WriteHeader(http.StatusOK) // 200 OK
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error("StationList", "Failed to write response.", err)
+			return
+		}
 	}
 }
@@ -4,11 +4,14 @@
 package main
 
 import (
-	"bufio"
+	"database/sql"
 	"fmt"
 	"io"
-	"net"
+	"io/fs"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,260 +20,433 @@ import (
 	"github.com/kenellorando/clog"
 )
 
-var now = RadioInfo{}
-
 type RadioInfo struct {
 	Song       SongData
 	Host       string
 	Mountpoint string
 	Listeners  float64
 	Bitrate    float64
+
+	// The title and artist as the stream reports them, which may differ from the library's tags.
+	// Song changes are detected on these.
+	streamTitle  string
+	streamArtist string
+	// The file Liquidsoap reported starting, and the ID of its request, when it reports tracks (see track.go).
+	streamPath string
+	streamRID  string
+	// When the song started playing.
+	startedAt time.Time
 }
 
 type SongData struct {
-	ID     int
-	Artist string
-	Title  string
-	Album  string
-	Genre  string
-	Year   int
-	Path   string
+	ID          int
+	Artist      string
+	Title       string
+	Album       string
+	Genre       string
+	Year        int
+	Path        string `json:"-"`
+	AlbumArtist string
+	Composer    string
+	Track       int
+	Disc        int
+	Duration    float64 // Seconds.
+	Format      string  // Audio file type, such as MP3 or FLAC.
 }
 
-// Takes a query string to search the database.
-// Returns a slice of SongData of songs ordered by relevance.
-func searchByQuery(query string) (queryResults []SongData, err error) {
-	query = strings.TrimSpace(query)
-	clog.Debug("searchByQuery", fmt.Sprintf("Searching database for query: '%v'", query))
-	selectWhereStatement := fmt.Sprintf("SELECT \"id\", \"artist\", \"title\",\"album\", \"genre\", \"year\" FROM %s ",
-		c.PostgresTableName) + "WHERE artist ILIKE $1 OR title ILIKE $2 ORDER BY LEAST(levenshtein($3, artist), levenshtein($4, title))"
-	rows, err := dbp.Query(selectWhereStatement, "%"+query+"%", "%"+query+"%", query, query)
-	if err != nil {
-		clog.Error("searchByQuery", "Database search failed.", err)
-		return nil, err
-	}
-	for rows.Next() {
-		song := &SongData{}
-		err = rows.Scan(&song.ID, &song.Artist, &song.Title, &song.Album, &song.Genre, &song.Year)
-		if err != nil {
-			clog.Error("searchByQuery", "Data scan failed.", err)
-			continue
-		}
-		queryResults = append(queryResults,
-			SongData{ID: song.ID, Artist: song.Artist, Title: song.Title, Album: song.Album, Genre: song.Genre, Year: song.Year})
-	}
-	return queryResults, nil
+// The columns of a song other than its ID, from a metadata table aliased m. Scanned by songScanTargets.
+const songColumns = `COALESCE(m.artist, ''), COALESCE(m.title, ''), COALESCE(m.album, ''), COALESCE(m.genre, ''), COALESCE(m.year, 0),
+	COALESCE(m.album_artist, ''), COALESCE(m.composer, ''), COALESCE(m.track, 0), COALESCE(m.disc, 0), COALESCE(m.duration, 0),
+	COALESCE(m.format, '')`
+
+// Returns the scan destinations for songColumns.
+func songScanTargets(song *SongData) []interface{} {
+	return []interface{}{&song.Artist, &song.Title, &song.Album, &song.Genre, &song.Year,
+		&song.AlbumArtist, &song.Composer, &song.Track, &song.Disc, &song.Duration, &song.Format}
 }
 
-// Takes a title and artist string to find a song which exactly matches.
-// Returns a list of SongData whose first result [0] is the first (best) match.
-// This will not work if multiple songs share the exact same title and artist.
-func searchByTitleArtist(title string, artist string) (queryResults []SongData, err error) {
+// Takes a title and artist string to find songs in the station's library which exactly match.
+// Returns the matching songs, oldest first.
+func (s *Server) searchByTitleArtist(st *Station, title string, artist string) (queryResults []SongData, err error) {
 	title, artist = strings.TrimSpace(title), strings.TrimSpace(artist)
 	clog.Debug("searchByTitleArtist", fmt.Sprintf("Searching database for: %s by %s", title, artist))
-	selectStatement := fmt.Sprintf("SELECT id,artist,title,album,genre,year FROM %s WHERE title LIKE $1 AND artist LIKE $2;",
-		c.PostgresTableName)
-	rows, err := dbp.Query(selectStatement, title, artist)
+	selectStatement := fmt.Sprintf("SELECT m.id, %s, m.path FROM %s m WHERE m.title = $1 AND m.artist = $2 AND ($3 = '' OR starts_with(m.path, $3)) ORDER BY m.id",
+		songColumns, s.Config.PostgresTableName)
+	rows, err := s.DB.Query(selectStatement, title, artist, st.libraryPrefix(s.Config.MusicDir))
 	if err != nil {
 		clog.Error("searchByTitleArtist", "Could not query DB.", err)
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		song := &SongData{}
-		err = rows.Scan(&song.ID, &song.Artist, &song.Title, &song.Album, &song.Genre, &song.Year)
+		var song SongData
+		targets := append([]interface{}{&song.ID}, songScanTargets(&song)...)
+		err = rows.Scan(append(targets, &song.Path)...)
 		if err != nil {
 			clog.Error("searchByTitleArtist", "Data scan failed.", err)
 			continue
 		}
-		queryResults = append(queryResults,
-			SongData{ID: song.ID, Artist: song.Artist, Title: song.Title, Album: song.Album, Genre: song.Genre, Year: song.Year})
+		queryResults = append(queryResults, song)
 	}
 	return queryResults, nil
 }
 
-// Takes a song ID integer.
-// Returns the absolute path of the audio file.
-func getPathById(id int) (path string, err error) {
-	clog.Debug("getPathById", fmt.Sprintf("Searching database for the path of song: '%v'", id))
-	selectWhereStatement := fmt.Sprintf("SELECT \"path\" FROM %s WHERE id=%v", c.PostgresTableName, id)
-	rows, err := dbp.Query(selectWhereStatement)
+// Takes the absolute path of an audio file. Returns its song, or errNotFound if it is not in the library.
+func (s *Server) songByPath(path string) (song SongData, err error) {
+	targets := append([]interface{}{&song.ID}, songScanTargets(&song)...)
+	err = s.DB.QueryRow(fmt.Sprintf("SELECT m.id, %s, m.path FROM %s m WHERE m.path = $1", songColumns, s.Config.PostgresTableName),
+		path).Scan(append(targets, &song.Path)...)
+	if err == sql.ErrNoRows {
+		return song, errNotFound
+	}
 	if err != nil {
-		clog.Error("getPathById", "Database search failed.", err)
-		return "", err
+		clog.Error("songByPath", "Could not query DB.", err)
 	}
-	for rows.Next() {
-		err = rows.Scan(&path)
-		if err != nil {
-			clog.Error("getPathById", "Data scan failed.", err)
-			return "", err
+	return song, err
+}
+
+// Finds the song a station has started playing. The file Liquidsoap has on air identifies it exactly;
+// when Liquidsoap cannot say, for example while it is unreachable, the song is matched by the title
+// and artist the stream reports.
+func (s *Server) resolveNowPlaying(st *Station, title string, artist string) SongData {
+	if s.DB == nil {
+		return SongData{Title: title, Artist: artist}
+	}
+	return s.resolveSong(st, s.liquidsoapOnAirPath(st, title, artist), title, artist)
+}
+
+// Finds a playing song by its file path, or by its title and artist if the path is empty or not
+// in the library. A song which is not in the library, such as a live show, keeps only its title and artist.
+func (s *Server) resolveSong(st *Station, path string, title string, artist string) SongData {
+	unknown := SongData{Title: title, Artist: artist}
+	if s.DB == nil {
+		return unknown
+	}
+	if path != "" {
+		song, err := s.songByPath(path)
+		if err == nil {
+			return song
+		}
+		if err == errNotFound {
+			clog.Debug("resolveSong", fmt.Sprintf("<%s> is playing but not in the library.", path))
 		}
 	}
-	return path, nil
+	songs, err := s.searchByTitleArtist(st, title, artist)
+	if err != nil || len(songs) == 0 {
+		return unknown
+	}
+	return songs[0]
 }
 
-// Takes an absolute song path, submits the path to be queued in Liquidsoap.
-// Returns the response message from Liquidsoap.
-func liquidsoapRequest(path string) (message string, err error) {
-	// Telnet to liquidsoap
-	clog.Debug("liquidsoapRequest", "Connecting to liquidsoap service...")
-	conn, err := net.Dial("tcp", c.LiquidsoapAddress+c.LiquidsoapPort)
+// Returns the path of the file a station's Liquidsoap is playing, or an empty string if it cannot tell.
+// A Liquidsoap serving several stations has several requests on air; the one whose metadata matches
+// the stream's title and artist is preferred, then the most recent one within the station's library.
+func (s *Server) liquidsoapOnAirPath(st *Station, title string, artist string) string {
+	rids, err := st.Liquidsoap.OnAir()
 	if err != nil {
-		clog.Error("liquidsoapRequest", "Failed to connect to audio source server.", err)
-		return "", err
+		clog.Debug("liquidsoapOnAirPath", fmt.Sprintf("Could not ask Liquidsoap what <%s> is playing: %v", st.Name, err))
+		return ""
 	}
-	defer conn.Close()
-	// Push song request to source service, listen for a response, and quit the telnet session.
-	fmt.Fprintf(conn, "request.push "+path+"\n")
-	message, err = bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		clog.Error("liquidsoapRequest", "Failed to read stream response message from audio source server.", err)
+	sort.Sort(sort.Reverse(sort.IntSlice(rids)))
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	candidate := ""
+	for _, rid := range rids {
+		metadata, err := st.Liquidsoap.Metadata(rid)
+		if err != nil {
+			return candidate
+		}
+		path := metadata["filename"]
+		if path == "" || (prefix != "" && !strings.HasPrefix(path, prefix)) {
+			continue
+		}
+		if metadata["title"] == title && metadata["artist"] == artist {
+			return path
+		}
+		if candidate == "" {
+			candidate = path
+		}
 	}
-	clog.Info("liquidsoapRequest", fmt.Sprintf("Message from audio source server: %s", message))
-	fmt.Fprintf(conn, "quit"+"\n")
-	return message, nil
+	return candidate
 }
 
-func liquidsoapSkip() (message string, err error) {
-	clog.Debug("liquidsoapRequest", "Connecting to liquidsoap service...")
-	conn, err := net.Dial("tcp", c.LiquidsoapAddress+c.LiquidsoapPort)
-	if err != nil {
-		clog.Error("liquidsoapRequest", "Failed to connect to audio source server.", err)
-		return "", err
+// Takes a station and a song ID integer.
+// Returns the absolute path of the audio file, or errNotFound if the song is not in the station's library.
+func (s *Server) getPathById(st *Station, id int) (path string, err error) {
+	clog.Debug("getPathById", fmt.Sprintf("Searching database for the path of song: '%v'", id))
+	selectWhereStatement := fmt.Sprintf("SELECT \"path\" FROM %s WHERE id=$1 AND ($2 = '' OR starts_with(path, $2))", s.Config.PostgresTableName)
+	err = s.DB.QueryRow(selectWhereStatement, id, st.libraryPrefix(s.Config.MusicDir)).Scan(&path)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
 	}
-	defer conn.Close()
-	fmt.Fprintf(conn, "cadence1.skip\n")
-	// Listen for response
-	message, err = bufio.NewReader(conn).ReadString('\n')
 	if err != nil {
-		clog.Error("liquidsoapSkip", "Failed to read stream response message from audio source server.", err)
+		clog.Error("getPathById", "Database search failed.", err)
+		return "", err
 	}
-	clog.Debug("liquidsoapSkip", fmt.Sprintf("Message from audio source server: %s", message))
-	fmt.Fprintf(conn, "quit"+"\n")
-	return message, nil
+	return path, nil
 }
 
-// Watches the music directory (CSERVER_MUSICDIR) for any changes, and reconfigures the database.
-func filesystemMonitor() {
+// How long the music directory must stay quiet before a batch of changes is indexed.
+// Copying an album in fires many events, which are merged into one index pass.
+const librarySettleTime = 3 * time.Second
+
+// Watches the music directory (CSERVER_MUSICDIR) and every directory beneath it for changes.
+// Bursts of events are merged, and only the changed paths are passed on to be reindexed.
+func (s *Server) filesystemMonitor() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		clog.Error("fileSystemMonitor", "Error creating watcher.", err)
 		return
 	}
 	defer watcher.Close()
-	err = watcher.Add(c.MusicDir)
+	err = watchRecursive(watcher, s.Config.MusicDir)
 	if err != nil {
 		clog.Error("fileSystemMonitor", "Error adding music directory to watcher.", err)
 		return
 	}
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case _, ok := <-watcher.Events:
-				if !ok {
-					continue
-				}
-				clog.Info("fileSystemMonitor", "Change detected in music library.")
-				err = postgresPopulate()
-				if err != nil {
-					clog.Error("fileSystemMonitor", "Failed to populate.", err)
-					return
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					continue
+	pending := make(map[string]bool)
+	settle := time.NewTimer(librarySettleTime)
+	settle.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				// New directories (an album being copied in) have to be watched too.
+				// Anything written into them before the watch was added is picked up
+				// when the directory itself is reindexed.
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchRecursive(watcher, event.Name); err != nil {
+						clog.Error("fileSystemMonitor", fmt.Sprintf("Error watching new directory <%s>.", event.Name), err)
+					}
 				}
-				clog.Error("fileSystemMonitor", "Error watching music library.", err)
 			}
+			clog.Debug("fileSystemMonitor", fmt.Sprintf("Change detected in music library: %s", event))
+			pending[event.Name] = true
+			settle.Reset(librarySettleTime)
+		case <-settle.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = make(map[string]bool)
+			clog.Info("fileSystemMonitor", fmt.Sprintf("Reindexing %d changed paths in music library.", len(paths)))
+			err = s.postgresIndex(paths)
+			if err != nil {
+				clog.Error("fileSystemMonitor", "Failed to reindex changed paths.", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			clog.Error("fileSystemMonitor", "Error watching music library.", err)
 		}
-	}()
-	<-done
+	}
 }
 
-// Watches the Icecast status page and updates stream info for SSE.
-func icecastMonitor() {
-	var prev = RadioInfo{}
-	// Resets now playing, stream URL, and listener global variables to defaults. Used when Icecast is unreachable.
-	icecastDataReset := func() {
-		now.Song.Title, now.Song.Artist, now.Host, now.Mountpoint = "-", "-", "-", "-"
-		now.Listeners = -1
-	}
-	checkIcecastStatus := func() {
-		resp, err := http.Get("http://" + c.IcecastAddress + c.IcecastPort + "/status-json.xsl")
-		if err != nil {
-			clog.Error("icecastMonitor", "Unable to stream data from the Icecast service.", err)
-			icecastDataReset()
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			clog.Debug("icecastMonitor", "Unable to connect to Icecast.")
-			icecastDataReset()
-			return
-		}
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			clog.Debug("icecastMonitor", "Connected to Icecast but unable to read response.")
-			icecastDataReset()
-			return
-		}
-		jsonParsed, err := gabs.ParseJSON([]byte(body))
+// Adds a directory and all of its subdirectories to the watcher.
+func watchRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			clog.Debug("icecastMonitor", "Connected to Icecast but unable to parse response.")
-			icecastDataReset()
-			return
+			return err
 		}
-		if jsonParsed.Path("icestats.source.title").Data() == nil || jsonParsed.Path("icestats.source.artist").Data() == nil {
-			clog.Debug("icecastMonitor", "Connected to Icecast, but saw nothing playing.")
-			icecastDataReset()
-			return
+		if !d.IsDir() {
+			return nil
 		}
+		clog.Debug("watchRecursive", fmt.Sprintf("Watching directory <%s>.", path))
+		return watcher.Add(path)
+	})
+}
 
-		now.Song.Artist = jsonParsed.Path("icestats.source.artist").Data().(string)
-		now.Song.Title = jsonParsed.Path("icestats.source.title").Data().(string)
-		now.Host = jsonParsed.Path("icestats.host").Data().(string)
-		now.Mountpoint = jsonParsed.Path("icestats.source.server_name").Data().(string)
-		now.Listeners = jsonParsed.Path("icestats.source.listeners").Data().(float64)
-		now.Bitrate = jsonParsed.Path("icestats.source.bitrate").Data().(float64)
-
-		if (prev.Song.Title != now.Song.Title) || (prev.Song.Artist != now.Song.Artist) {
-			clog.Info("icecastMonitor", fmt.Sprintf("Now Playing: %s by %s", now.Song.Title, now.Song.Artist))
-			// Dump the artwork rate limiter database first thing before updates
-			// are sent out to reset artwork request count.
-			dbr.RateLimitArt.FlushDB(ctx)
+// How often the Icecast status page is read. When Liquidsoap reports tracks itself,
+// Icecast is only asked for listener counts, which may be a little stale.
+const icecastPollInterval = 1 * time.Second
+const icecastListenerPollInterval = 5 * time.Second
 
-			radiodata_sse.SendEventMessage(now.Song.Title, "title", "")
-			radiodata_sse.SendEventMessage(now.Song.Artist, "artist", "")
-			if (prev.Song.Title != "") && (prev.Song.Artist != "") {
-				history = append(history, playRecord{Title: prev.Song.Title, Artist: prev.Song.Artist, Ended: time.Now()})
-				if len(history) > 10 {
-					history = history[1:]
-				}
-				radiodata_sse.SendEventMessage("update", "history", "")
+// Watches the Icecast status page and updates a station's stream info for SSE.
+func (s *Server) icecastMonitor(st *Station) {
+	var prev = RadioInfo{}
+	var lastSample time.Time
+	interval := icecastPollInterval
+	if s.trackPushEnabled() {
+		interval = icecastListenerPollInterval
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			s.icecastCheck(st, &prev)
+			// Keep the listener count as a time series for statistics, skipping while Icecast is unreachable.
+			if now := st.nowPlaying(); time.Since(lastSample) >= listenerSampleInterval && now.Listeners >= 0 {
+				lastSample = time.Now()
+				s.statsRecordListeners(st, int(now.Listeners), lastSample)
 			}
 		}
-		if (prev.Host != now.Host) || (prev.Mountpoint != now.Mountpoint) {
-			clog.Info("icecastMonitor", fmt.Sprintf("Audio stream on: <%s/%s>", now.Host, now.Mountpoint))
-			radiodata_sse.SendEventMessage(fmt.Sprintf(now.Host, "/", now.Mountpoint), "listenurl", "")
+	}()
+}
+
+// Resets now playing, stream URL, and listener variables of a station to defaults. Used when Icecast is unreachable.
+// The song is kept when Liquidsoap reports tracks itself, since it does not depend on Icecast.
+func (s *Server) icecastDataReset(st *Station) {
+	push := s.trackPushEnabled()
+	st.updateNowPlaying(func(now *RadioInfo) {
+		if !push {
+			now.Song = SongData{Title: "-", Artist: "-"}
+			now.streamTitle, now.streamArtist = "-", "-"
+			now.startedAt = time.Time{}
 		}
-		if prev.Listeners != now.Listeners {
-			clog.Info("icecastMonitor", fmt.Sprintf("Listener count: <%v>", now.Listeners))
-			radiodata_sse.SendEventMessage(fmt.Sprint(now.Listeners), "listeners", "")
+		now.Host, now.Mountpoint = "-", "-"
+		now.Listeners = -1
+	})
+}
+
+// Returns the source in an Icecast status document which serves the given mount.
+// Icecast reports a single source as an object and several sources as an array.
+func icecastSource(status *gabs.Container, mountpoint string) *gabs.Container {
+	source := status.Path("icestats.source")
+	if _, isArray := source.Data().([]interface{}); isArray {
+		sources, _ := source.Children()
+		for _, candidate := range sources {
+			if icecastSourceMount(candidate) == mountpoint {
+				return candidate
+			}
 		}
-		prev = now
+		return nil
 	}
-	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			checkIcecastStatus()
+	if source.Data() == nil {
+		return nil
+	}
+	if mount := icecastSourceMount(source); mount != "" && mount != mountpoint {
+		return nil
+	}
+	return source
+}
+
+// Returns the mount a source is served on, taken from the end of its listen URL.
+func icecastSourceMount(source *gabs.Container) string {
+	listenurl, ok := source.Path("listenurl").Data().(string)
+	if !ok {
+		if name, ok := source.Path("server_name").Data().(string); ok {
+			return name
 		}
-	}()
+		return ""
+	}
+	return listenurl[strings.LastIndex(listenurl, "/")+1:]
 }
 
-var history = make([]playRecord, 0, 10)
+// Tells SSE clients about the song a station started playing and records it in the play history.
+func (s *Server) announceTrack(st *Station, prev RadioInfo, now RadioInfo) {
+	clog.Info("announceTrack", fmt.Sprintf("Now Playing on <%s>: %s by %s (song <%d>)", st.Name, now.Song.Title, now.Song.Artist, now.Song.ID))
+	st.publishNowPlaying()
+	st.SSE.SendEventMessage(now.Song.Title, "title")
+	st.SSE.SendEventMessage(now.Song.Artist, "artist")
+	err := s.historyRecordPlay(st, now, now.startedAt)
+	if err == nil && (prev.Song.Title != "") && (prev.Song.Artist != "") {
+		st.SSE.SendEventMessage("update", "history")
+	}
+}
 
-type playRecord struct {
-	Title  string
-	Artist string
-	Ended  time.Time
+// Reads the Icecast status page once and updates the station's now playing.
+// SSE events are sent for anything which differs from prev, which is then replaced with the new state.
+func (s *Server) icecastCheck(st *Station, prev *RadioInfo) {
+	start := time.Now()
+	defer func() {
+		s.metrics.icecastPollDuration.WithLabelValues(st.Name).Observe(time.Since(start).Seconds())
+	}()
+	reset := func() {
+		s.icecastDataReset(st)
+		s.icecastPublish(st, prev, false)
+	}
+	pollFailed := func() {
+		s.metrics.icecastPollFailures.WithLabelValues(st.Name).Inc()
+		reset()
+	}
+	resp, err := http.Get("http://" + st.IcecastAddress + "/status-json.xsl")
+	if err != nil {
+		clog.Error("icecastMonitor", "Unable to stream data from the Icecast service.", err)
+		pollFailed()
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		clog.Debug("icecastMonitor", "Unable to connect to Icecast.")
+		pollFailed()
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		clog.Debug("icecastMonitor", "Connected to Icecast but unable to read response.")
+		pollFailed()
+		return
+	}
+	jsonParsed, err := gabs.ParseJSON([]byte(body))
+	if err != nil {
+		clog.Debug("icecastMonitor", "Connected to Icecast but unable to parse response.")
+		pollFailed()
+		return
+	}
+	source := icecastSource(jsonParsed, st.Mountpoint)
+	if source == nil {
+		clog.Debug("icecastMonitor", fmt.Sprintf("Connected to Icecast, but mount <%s> is not active.", st.Mountpoint))
+		reset()
+		return
+	}
+	artist, okArtist := source.Path("artist").Data().(string)
+	title, okTitle := source.Path("title").Data().(string)
+	if !okArtist || !okTitle {
+		clog.Debug("icecastMonitor", "Connected to Icecast, but saw nothing playing.")
+		reset()
+		return
+	}
+
+	// Icecast's title and artist are only used when Liquidsoap does not report tracks itself.
+	var song SongData
+	changed := false
+	if !s.trackPushEnabled() {
+		current := st.nowPlaying()
+		if changed = (current.streamTitle != title) || (current.streamArtist != artist); changed {
+			song = s.resolveNowPlaying(st, title, artist)
+		}
+	}
+	_, now := st.updateNowPlaying(func(now *RadioInfo) {
+		if changed {
+			now.Song = song
+			now.streamTitle, now.streamArtist = title, artist
+			now.startedAt = time.Now()
+		}
+		now.Host, _ = jsonParsed.Path("icestats.host").Data().(string)
+		now.Mountpoint = st.Mountpoint
+		now.Listeners, _ = source.Path("listeners").Data().(float64)
+		now.Bitrate, _ = source.Path("bitrate").Data().(float64)
+	})
+
+	announced := !s.trackPushEnabled() && ((prev.streamTitle != now.streamTitle) || (prev.streamArtist != now.streamArtist))
+	if announced {
+		s.announceTrack(st, *prev, now)
+	}
+	s.icecastPublish(st, prev, announced)
+}
+
+// Sends SSE events for the stream details which differ from prev, which is then replaced with the station's state.
+// The nowplaying event is sent too, unless the caller has just sent it.
+func (s *Server) icecastPublish(st *Station, prev *RadioInfo, sentNowPlaying bool) {
+	now := st.nowPlaying()
+	changed := false
+	if (prev.Host != now.Host) || (prev.Mountpoint != now.Mountpoint) {
+		clog.Info("icecastMonitor", fmt.Sprintf("Audio stream on: <%s/%s>", now.Host, now.Mountpoint))
+		st.SSE.SendEventMessage(now.Host+"/"+now.Mountpoint, "listenurl")
+		changed = true
+	}
+	if prev.Listeners != now.Listeners {
+		clog.Info("icecastMonitor", fmt.Sprintf("Listener count on <%s>: <%v>", st.Name, now.Listeners))
+		st.SSE.SendEventMessage(fmt.Sprint(now.Listeners), "listeners")
+		changed = true
+	}
+	if changed && !sentNowPlaying {
+		st.publishNowPlaying()
+	}
+	*prev = now
 }
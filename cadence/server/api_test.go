@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds a server with a single station wired to fresh fakes, which is closed when the test ends.
+func newTestServer(t *testing.T) (*Server, *fakeLiquidsoap, *fakeIcecast) {
+	t.Helper()
+	fakeLS, fakeIC := newFakeLiquidsoap(t), newFakeIcecast(t)
+	s := NewServer(ServerConfig{IcecastAddress: fakeIC.Addr(), LiquidsoapAddress: fakeLS.Addr()})
+	t.Cleanup(s.Close)
+	return s, fakeLS, fakeIC
+}
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// Subscribes to the radio data event stream. Events after the current state, which is sent
+// on connecting, are delivered on the returned channel.
+func subscribeSSE(t *testing.T, st *Station) <-chan sseEvent {
+	t.Helper()
+	events := subscribeSSEWith(t, st, "", nil)
+	for range st.sseSnapshot() {
+		<-events
+	}
+	return events
+}
+
+// Subscribes to the radio data event stream with a query and request headers. Every event is
+// delivered on the returned channel, starting with the current state.
+func subscribeSSEWith(t *testing.T, st *Station, query string, header http.Header) <-chan sseEvent {
+	t.Helper()
+	server := httptest.NewServer(st.SSE)
+	t.Cleanup(server.Close)
+	req, _ := http.NewRequest(http.MethodGet, server.URL+query, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe to SSE: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	for deadline := time.Now().Add(time.Second); st.SSE.ConsumersCount() < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("SSE consumer was never registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	events := make(chan sseEvent, 32)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var e sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				e.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.Data = strings.TrimPrefix(line, "data: ")
+			case line == "":
+				events <- e
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// Reads events until one with the given name arrives, failing the test after a timeout.
+func expectSSE(t *testing.T, events <-chan sseEvent, name string) sseEvent {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("SSE stream closed while waiting for %q", name)
+			}
+			if e.Event == name {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for SSE event %q", name)
+		}
+	}
+}
+
+func TestIcecastNowPlayingChanges(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	events := subscribeSSE(t, st)
+	var prev RadioInfo
+
+	fakeIC.SetPlaying("First Song", "First Artist", 3)
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.Title != "First Song" || now.Song.Artist != "First Artist" || now.Listeners != 3 {
+		t.Fatalf("now playing is %+v", now)
+	}
+	if e := expectSSE(t, events, "title"); e.Data != "First Song" {
+		t.Errorf("title event carried %q", e.Data)
+	}
+	if e := expectSSE(t, events, "artist"); e.Data != "First Artist" {
+		t.Errorf("artist event carried %q", e.Data)
+	}
+	if e := expectSSE(t, events, "listeners"); e.Data != "3" {
+		t.Errorf("listeners event carried %q", e.Data)
+	}
+
+	fakeIC.SetPlaying("Second Song", "Second Artist", 3)
+	s.icecastCheck(st, &prev)
+	expectSSE(t, events, "title")
+	expectSSE(t, events, "history")
+}
+
+func TestIcecastUnreachable(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	var prev RadioInfo
+
+	fakeIC.SetPlaying("Song", "Artist", 1)
+	s.icecastCheck(st, &prev)
+	fakeIC.SetStatus(http.StatusServiceUnavailable, "")
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.Title != "-" || now.Song.Artist != "-" || now.Listeners != -1 {
+		t.Errorf("now playing was not reset: %+v", now)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Listeners(st).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/listeners", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"Listeners":-1}` {
+		t.Errorf("/api/listeners returned %s", got)
+	}
+}
+
+func TestLiquidsoapOnAirPath(t *testing.T) {
+	s, fakeLS, _ := newTestServer(t)
+	st := s.defaultStation()
+	if path := s.liquidsoapOnAirPath(st, "Song", "Artist"); path != "" {
+		t.Errorf("nothing is on air, yet the path is %q", path)
+	}
+	fakeLS.PlayFile("/music/a.mp3", "Song", "Artist")
+	fakeLS.PlayFile("/music/b.mp3", "Other Song", "Artist")
+	// The request whose metadata matches the stream wins over the most recent one.
+	if path := s.liquidsoapOnAirPath(st, "Song", "Artist"); path != "/music/a.mp3" {
+		t.Errorf("on air path is %q", path)
+	}
+	if path := s.liquidsoapOnAirPath(st, "Live Show", "DJ"); path != "/music/b.mp3" {
+		t.Errorf("unmatched on air path is %q", path)
+	}
+	// Files outside a station's library belong to another station.
+	st.LibraryDir = "jazz"
+	s.Config.MusicDir = "/music"
+	if path := s.liquidsoapOnAirPath(st, "Song", "Artist"); path != "" {
+		t.Errorf("on air path outside the library is %q", path)
+	}
+}
+
+// Songs sharing a title and artist are told apart by the file Liquidsoap has on air.
+func TestNowPlayingByPath(t *testing.T) {
+	requirePostgres(t)
+	s, fakeLS, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "studio.mp3"), "Song", "Artist")
+	live := filepath.Join(s.Config.MusicDir, "live.mp3")
+	writeTaggedMP3(t, live, "Song", "Artist")
+	connectTestPostgres(t, s)
+
+	var prev RadioInfo
+	fakeLS.PlayFile(live, "Song", "Artist")
+	fakeIC.SetPlaying("Song", "Artist", 1)
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.ID == 0 || now.Song.Path != live {
+		t.Fatalf("now playing is %+v", now.Song)
+	}
+	rec := httptest.NewRecorder()
+	s.NowPlayingMetadata(st).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/nowplaying/metadata", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), live) {
+		t.Errorf("/api/nowplaying/metadata returned %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Something which is not in the library keeps the stream's title and artist, but has no song.
+	fakeIC.SetPlaying("Live Show", "DJ", 1)
+	fakeLS.PlayNext()
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.ID != 0 || now.Song.Title != "Live Show" {
+		t.Errorf("now playing is %+v", now.Song)
+	}
+	rec = httptest.NewRecorder()
+	s.NowPlayingMetadata(st).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/nowplaying/metadata", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/api/nowplaying/metadata returned %d for a song outside the library", rec.Code)
+	}
+}
+
+func TestStationsShareIcecast(t *testing.T) {
+	fakeLS, fakeIC := newFakeLiquidsoap(t), newFakeIcecast(t)
+	s := NewServer(ServerConfig{Stations: []StationConfig{
+		{Name: "main", IcecastAddress: fakeIC.Addr(), LiquidsoapAddress: fakeLS.Addr(), Mountpoint: "main", Output: "main"},
+		{Name: "chill", IcecastAddress: fakeIC.Addr(), LiquidsoapAddress: fakeLS.Addr(), Mountpoint: "chill", Output: "chill"},
+	}})
+	t.Cleanup(s.Close)
+	fakeIC.SetStatus(http.StatusOK, `{"icestats":{"host":"stream.example.com","source":[
+		{"artist":"Main Artist","title":"Main Song","listeners":5,"bitrate":192,"listenurl":"http://stream.example.com:8000/main"},
+		{"artist":"Chill Artist","title":"Chill Song","listeners":2,"bitrate":128,"listenurl":"http://stream.example.com:8000/chill"}]}}`)
+
+	for _, st := range s.Stations {
+		var prev RadioInfo
+		s.icecastCheck(st, &prev)
+	}
+	mainNow, chillNow := s.Stations[0].nowPlaying(), s.Stations[1].nowPlaying()
+	if mainNow.Song.Title != "Main Song" || mainNow.Listeners != 5 {
+		t.Errorf("main station is playing %+v", mainNow)
+	}
+	if chillNow.Song.Title != "Chill Song" || chillNow.Listeners != 2 {
+		t.Errorf("chill station is playing %+v", chillNow)
+	}
+
+	routes := s.routes()
+	for path, want := range map[string]string{
+		"/api/chill/listeners": `{"Listeners":2}`,
+		"/api/main/listeners":  `{"Listeners":5}`,
+		"/api/listeners":       `{"Listeners":5}`,
+	} {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("%s returned %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestDevSkip(t *testing.T) {
+	s, fakeLS, _ := newTestServer(t)
+	st := s.defaultStation()
+
+	rec := httptest.NewRecorder()
+	s.DevSkip(st).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/dev/skip", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/api/dev/skip returned %d", rec.Code)
+	}
+	if got := fakeLS.Commands(); len(got) != 1 || got[0] != "cadence1.skip" {
+		t.Errorf("fake liquidsoap received %v", got)
+	}
+}
+
+// Exercises a request from the HTTP handler through to Liquidsoap playing it.
+// This needs a disposable Postgres server, configured through the usual CSERVER_POSTGRES* variables.
+func TestRequestFlow(t *testing.T) {
+	requirePostgres(t)
+	s, fakeLS, _ := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	songPath := filepath.Join(s.Config.MusicDir, "song.mp3")
+	writeTaggedMP3(t, songPath, "Test Title", "Test Artist")
+	connectTestPostgres(t, s)
+	songs, _, err := s.searchByQuery(st, "Test Title", 10, 0)
+	if err != nil || len(songs) != 1 {
+		t.Fatalf("search returned %v, %v", songs, err)
+	}
+
+	body := fmt.Sprintf(`{"ID":"%d"}`, songs[0].ID)
+	req := httptest.NewRequest(http.MethodPost, "/api/request/id", strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	s.RequestID(st).ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/api/request/id returned %d", rec.Code)
+	}
+
+	s.requestQueueSync(st)
+	if got := fakeLS.Commands(); !containsCommand(got, "request.push "+songPath) {
+		t.Fatalf("fake liquidsoap received %v", got)
+	}
+	assertQueueStatus(t, s, queueStatusPushed)
+	fakeLS.PlayNext()
+	s.requestQueueSync(st)
+	assertQueueStatus(t, s, queueStatusPlaying)
+	fakeLS.PlayNext()
+	s.requestQueueSync(st)
+	assertQueueStatus(t, s)
+}
+
+// Records plays through the Icecast monitor and pages through them with the history API.
+func TestPlayHistory(t *testing.T) {
+	requirePostgres(t)
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "song.mp3"), "Song 2", "Artist")
+	connectTestPostgres(t, s)
+
+	var prev RadioInfo
+	for i := 1; i <= 3; i++ {
+		fakeIC.SetPlaying(fmt.Sprintf("Song %d", i), "Artist", i)
+		s.icecastCheck(st, &prev)
+	}
+	// The same track change announced again, as when the monitor loses its previous state, is not a new play.
+	prev = RadioInfo{}
+	s.icecastCheck(st, &prev)
+
+	history := func(query string) (plays []PlayRecord, next string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.History(st).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil))
+		var body struct {
+			Plays      []PlayRecord
+			NextCursor string
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("/api/history?%s returned %d %s", query, rec.Code, rec.Body.String())
+		}
+		return body.Plays, body.NextCursor
+	}
+	page, next := history("limit=2")
+	if len(page) != 2 || page[0].Title != "Song 3" || page[0].Ended != nil || page[1].Title != "Song 2" || page[1].Ended == nil || next == "" {
+		t.Fatalf("first page is %+v, next %q", page, next)
+	}
+	if page[1].SongID == nil || page[1].Listeners != 2 {
+		t.Errorf("Song 2 was recorded as %+v", page[1])
+	}
+	page, next = history("limit=2&cursor=" + next)
+	if len(page) != 1 || page[0].Title != "Song 1" || page[0].SongID != nil || next != "" {
+		t.Fatalf("second page is %+v, next %q", page, next)
+	}
+	page, _ = history("until=" + page[0].Started.Add(-time.Second).Format(time.RFC3339))
+	if len(page) != 0 {
+		t.Errorf("plays before the first one: %+v", page)
+	}
+}
+
+// A song played twice in a row is recorded twice, while a repeated report of one track change is recorded once.
+func TestPlayHistoryRepeats(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.TrackSecret = "secret"
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	path := filepath.Join(s.Config.MusicDir, "song.mp3")
+	writeTaggedMP3(t, path, "Song", "Artist")
+	connectTestPostgres(t, s)
+
+	for _, rid := range []string{"1", "1", "2"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/internal/track",
+			strings.NewReader(fmt.Sprintf(`{"filename": %q, "title": "Song", "artist": "Artist", "rid": %q}`, path, rid)))
+		req.Header.Set("Authorization", "Bearer secret")
+		s.routes().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	plays, _, err := s.historyList(st, time.Time{}, time.Time{}, 10, "")
+	if err != nil || len(plays) != 2 || plays[0].Ended != nil || plays[1].Ended == nil {
+		t.Errorf("plays are %+v, %v", plays, err)
+	}
+	// Recording the track change on air again changes nothing.
+	if err = s.historyRecordPlay(st, st.nowPlaying(), st.nowPlaying().startedAt); err != nil {
+		t.Fatal(err)
+	}
+	if again, _, _ := s.historyList(st, time.Time{}, time.Time{}, 10, ""); len(again) != 2 {
+		t.Errorf("plays after recording the same change again are %+v", again)
+	}
+}
+
+// Skips a test unless a disposable Postgres server is configured.
+func requirePostgres(t *testing.T) {
+	t.Helper()
+	if os.Getenv("CADENCE_TEST_POSTGRES") == "" {
+		t.Skip("set CADENCE_TEST_POSTGRES=1 and the CSERVER_POSTGRES* variables to run against a disposable Postgres")
+	}
+}
+
+// Points the server at the test database and creates its tables, as a server starting up would.
+func connectTestPostgres(t *testing.T, s *Server) {
+	t.Helper()
+	openTestPostgres(t, s)
+	for _, init := range []func() error{s.postgresMigrate, s.postgresPopulate} {
+		if err := init(); err != nil {
+			t.Fatalf("creating test tables: %v", err)
+		}
+	}
+}
+
+// Connects the server to a schema of its own in the test database, which is dropped when the test ends.
+// The schema comes first in the search path, so nothing outside it is created, changed or dropped.
+func openTestPostgres(t *testing.T, s *Server) {
+	t.Helper()
+	s.Config.PostgresAddress = os.Getenv("CSERVER_POSTGRESADDRESS")
+	s.Config.PostgresPort = os.Getenv("CSERVER_POSTGRESPORT")
+	s.Config.PostgresUser = os.Getenv("CSERVER_POSTGRESUSER")
+	s.Config.PostgresPassword = os.Getenv("POSTGRES_PASSWORD")
+	s.Config.PostgresSSL = os.Getenv("CSERVER_POSTGRESSSL")
+	s.Config.PostgresTableName = "metadata_test"
+	if err := s.postgresInit(); err != nil {
+		t.Fatalf("postgresInit: %v", err)
+	}
+	admin := s.DB
+	schema := fmt.Sprintf("cadence_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("creating test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping test schema: %v", err)
+		}
+		admin.Close()
+	})
+	// pg_trgm was installed outside the schema by postgresInit, so public stays in the path to find it.
+	db, err := sql.Open("postgres", s.postgresDSN()+fmt.Sprintf(" search_path='%s,public'", schema))
+	if err != nil {
+		t.Fatalf("connecting to test schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s.DB = db
+}
+
+func assertQueueStatus(t *testing.T, s *Server, want ...string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.RequestQueue(s.defaultStation()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/request/queue", nil))
+	var entries []QueueEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("/api/request/queue returned %s", rec.Body.String())
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("queue has %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Status != want[i] {
+			t.Errorf("queue entry %d is %s, want %s", i, e.Status, want[i])
+		}
+	}
+}
+
+func containsCommand(commands []string, command string) bool {
+	for _, cmd := range commands {
+		if cmd == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a file holding only an ID3v2.3 tag with title and artist frames, which is enough for tag.ReadFrom.
+func writeTaggedMP3(t *testing.T, path string, title string, artist string) {
+	t.Helper()
+	writeTaggedMP3Frames(t, path, [2]string{"TIT2", title}, [2]string{"TPE1", artist})
+}
+
+// Writes a file holding only an ID3v2.3 tag with the given text frames, each an ID and its text.
+func writeTaggedMP3Frames(t *testing.T, path string, textFrames ...[2]string) {
+	t.Helper()
+	var frames bytes.Buffer
+	for _, frame := range textFrames {
+		frames.WriteString(frame[0])
+		binary.Write(&frames, binary.BigEndian, uint32(len(frame[1])+1))
+		frames.Write([]byte{0, 0, 0}) // Flags, then ISO-8859-1 text encoding.
+		frames.WriteString(frame[1])
+	}
+	size := frames.Len()
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	if err := os.WriteFile(path, append(header, frames.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	// Redis is only checked when rate limits are counted there.
+	s.rateLimiter = NewRedisRateLimiter("127.0.0.1:1")
+	fakeIC.SetPlaying("Song", "Artist", 1)
+	routes := s.routes()
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/live returned %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var report struct {
+		Ready      bool
+		Components []ComponentStatus
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("/ready returned %s", rec.Body.String())
+	}
+	if rec.Code != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("/ready returned %d without Postgres or Redis", rec.Code)
+	}
+	want := map[string]bool{"postgres": false, "redis": false, "icecast:cadence1": true, "liquidsoap:cadence1": true}
+	if len(report.Components) != len(want) {
+		t.Errorf("components are %+v", report.Components)
+	}
+	for _, c := range report.Components {
+		if ready, ok := want[c.Name]; !ok || c.Ready != ready || (c.Error == "") != ready {
+			t.Errorf("component %+v, want ready %v", c, ready)
+		}
+	}
+}
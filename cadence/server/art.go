@@ -0,0 +1,370 @@
+// art.go
+// Album art: found while indexing, stored once per distinct picture, and served as images
+// with the original and resized variants cached on disk.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Registers GIF decoding for image.Decode.
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+	"github.com/kenellorando/clog"
+	"golang.org/x/image/draw"
+)
+
+// The sizes art is resized to. A requested size is rounded up to the next of these, so that
+// the disk cache holds a handful of variants of each picture rather than one per pixel count.
+var artSizes = []int{64, 128, 256, 300, 512, 600, 1024, 2048}
+
+// How long clients and proxies may reuse art without revalidating it.
+const artCacheControl = "public, max-age=86400"
+
+const artTableName = "art"
+
+var errNoArt = errors.New("song has no album art")
+var errInvalidArtSize = errors.New("invalid art size")
+
+// A cached picture, ready to be served.
+type artFile struct {
+	Path        string
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+var artExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif"}
+
+// Rounds a requested size up to one of artSizes. Zero asks for the original picture.
+func artSize(query string) (int, error) {
+	if query == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(query)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("%w <%s>", errInvalidArtSize, query)
+	}
+	for _, s := range artSizes {
+		if size <= s {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("%w <%s>", errInvalidArtSize, query)
+}
+
+// Returns the cached art of a song at the given size, writing or resizing it first if it is not cached yet.
+// Returns errNotFound if there is no such song, and errNoArt if it has no picture.
+func (s *Server) artCached(songID int, size int) (art artFile, err error) {
+	var artID sql.NullInt64
+	var hash, contentType string
+	var modTime time.Time
+	err = s.DB.QueryRow(fmt.Sprintf(`SELECT m.art_id, COALESCE(a.hash, ''), COALESCE(a.mime, ''), COALESCE(a.added_at, 'epoch')
+	FROM %s m LEFT JOIN %s a ON a.id = m.art_id WHERE m.id = $1`, s.Config.PostgresTableName, artTableName),
+		songID).Scan(&artID, &hash, &contentType, &modTime)
+	if err == sql.ErrNoRows {
+		return art, errNotFound
+	}
+	if err != nil {
+		clog.Error("artCached", "Failed to look up song art.", err)
+		return art, err
+	}
+	if !artID.Valid {
+		return art, errNoArt
+	}
+	// Pictures are stored once by content hash, so songs sharing a cover share its cache files and ETag.
+	key := strings.TrimSpace(hash)
+	original := artFile{Path: filepath.Join(s.Config.ArtCacheDir, key+"-0"+artExtensions[contentType]), ContentType: contentType}
+	art, err = s.artFlights.do(key+"-0", func() (artFile, error) {
+		if _, err := os.Stat(original.Path); err == nil {
+			return original, nil
+		}
+		var data []byte
+		err := s.DB.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE id = $1", artTableName), artID).Scan(&data)
+		if err != nil {
+			clog.Error("artCached", "Failed to load art.", err)
+			return original, err
+		}
+		return original, writeArtCacheFile(original.Path, data)
+	})
+	if err == nil && size > 0 {
+		art, err = s.artFlights.do(fmt.Sprintf("%s-%d", key, size), func() (artFile, error) {
+			return s.artResized(original, key, size)
+		})
+	}
+	if err != nil {
+		return art, err
+	}
+	// Flights are shared with callers asking for other sizes, so only the cache file comes from them.
+	art.ModTime = modTime
+	art.ETag = fmt.Sprintf(`"%s-%d"`, key, size)
+	return art, nil
+}
+
+// Runs the work of filling each art cache entry once: callers asking for an entry which is already
+// being written wait for it and share the result, while different entries are written in parallel.
+// The result describes the cache file alone, since it is handed to every caller waiting on the flight.
+type artFlights struct {
+	mu      sync.Mutex
+	flights map[string]*artFlight
+}
+
+type artFlight struct {
+	done chan struct{}
+	art  artFile
+	err  error
+}
+
+func (f *artFlights) do(key string, fill func() (artFile, error)) (artFile, error) {
+	f.mu.Lock()
+	if flight, ok := f.flights[key]; ok {
+		f.mu.Unlock()
+		<-flight.done
+		return flight.art, flight.err
+	}
+	if f.flights == nil {
+		f.flights = make(map[string]*artFlight)
+	}
+	flight := &artFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	f.mu.Unlock()
+
+	flight.art, flight.err = fill()
+	f.mu.Lock()
+	delete(f.flights, key)
+	f.mu.Unlock()
+	close(flight.done)
+	return flight.art, flight.err
+}
+
+// Returns the picture for an audio file: its embedded picture if it has one,
+// otherwise an image such as cover.jpg in the same directory. Returns nil if there is neither.
+func findArt(audioPath string, tags tag.Metadata) (data []byte, contentType string) {
+	if picture := tags.Picture(); picture != nil && len(picture.Data) > 0 {
+		contentType = http.DetectContentType(picture.Data)
+		if _, ok := artExtensions[contentType]; ok {
+			return picture.Data, contentType
+		}
+	}
+	path := folderImage(filepath.Dir(audioPath))
+	if path == "" {
+		return nil, ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		clog.Warn("findArt", fmt.Sprintf("Could not read folder image <%s>: %v", path, err))
+		return nil, ""
+	}
+	contentType = http.DetectContentType(data)
+	if _, ok := artExtensions[contentType]; !ok {
+		return nil, ""
+	}
+	return data, contentType
+}
+
+// Names of images which hold the art of the audio files beside them, most preferred first.
+var folderImageNames = []string{"cover", "folder", "front"}
+
+// Reports whether the path names a folder image such as cover.jpg, in any letter case.
+func isFolderImage(path string) bool {
+	base := strings.ToLower(filepath.Base(path))
+	ext := filepath.Ext(base)
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".gif" {
+		return false
+	}
+	for _, name := range folderImageNames {
+		if strings.TrimSuffix(base, ext) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the most preferred folder image in a directory, or an empty string if it has none.
+func folderImage(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	best, bestRank := "", len(folderImageNames)
+	for _, entry := range entries {
+		if entry.IsDir() || !isFolderImage(entry.Name()) {
+			continue
+		}
+		base := strings.ToLower(entry.Name())
+		for rank, name := range folderImageNames {
+			if strings.TrimSuffix(base, filepath.Ext(base)) == name && rank < bestRank {
+				best, bestRank = filepath.Join(dir, entry.Name()), rank
+			}
+		}
+	}
+	return best
+}
+
+// Stores a picture unless an identical one is already stored, and returns its ID.
+func upsertArt(tx *sql.Tx, data []byte, contentType string) (id sql.NullInt64, err error) {
+	if data == nil {
+		return id, nil
+	}
+	sum := sha256.Sum256(data)
+	// The no-op update makes RETURNING give the ID of an existing row too.
+	err = tx.QueryRow(fmt.Sprintf(`INSERT INTO %s (hash, mime, data) VALUES ($1, $2, $3)
+	ON CONFLICT (hash) DO UPDATE SET hash = EXCLUDED.hash RETURNING id`, artTableName),
+		hex.EncodeToString(sum[:]), contentType, data).Scan(&id)
+	return id, err
+}
+
+// Returns the original resized to fit within size pixels, creating the cached variant if needed.
+// Pictures which are already small enough, or cannot be decoded, are served as they are: a copy of
+// the original is cached under the size, so later requests for it need not decode the picture again.
+func (s *Server) artResized(original artFile, key string, size int) (art artFile, err error) {
+	art = original
+	ext := ".jpg"
+	if original.ContentType == "image/png" {
+		ext = ".png" // Kept as PNG to preserve transparency.
+	}
+	path := filepath.Join(s.Config.ArtCacheDir, fmt.Sprintf("%s-%d%s", key, size, ext))
+	if _, err = os.Stat(path); err == nil {
+		art.Path, art.ContentType = path, mimeByArtExtension(ext)
+		return art, nil
+	}
+	// Originals of another type than the resized variants would have, such as GIFs, are cached under their own extension.
+	unresized := filepath.Join(s.Config.ArtCacheDir, fmt.Sprintf("%s-%d%s", key, size, artExtensions[original.ContentType]))
+	if _, err = os.Stat(unresized); err == nil {
+		art.Path = unresized
+		return art, nil
+	}
+
+	data, err := os.ReadFile(original.Path)
+	if err != nil {
+		return art, err
+	}
+	serveOriginal := func() (artFile, error) {
+		if err := writeArtCacheFile(unresized, data); err != nil {
+			return original, nil
+		}
+		art.Path = unresized
+		return art, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		clog.Warn("artResized", fmt.Sprintf("Could not decode art <%s>, serving it unresized: %v", original.Path, err))
+		return serveOriginal()
+	}
+	bounds := src.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return serveOriginal()
+	}
+	width, height := size, bounds.Dy()*size/bounds.Dx()
+	if bounds.Dy() > bounds.Dx() {
+		width, height = bounds.Dx()*size/bounds.Dy(), size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	var resized bytes.Buffer
+	if ext == ".png" {
+		err = png.Encode(&resized, dst)
+	} else {
+		err = jpeg.Encode(&resized, dst, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return art, err
+	}
+	art.Path, art.ContentType = path, mimeByArtExtension(ext)
+	return art, writeArtCacheFile(path, resized.Bytes())
+}
+
+func mimeByArtExtension(ext string) string {
+	for contentType, e := range artExtensions {
+		if e == ext {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// Writes a cache file through a temporary file, so a file is never served half written.
+func writeArtCacheFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		clog.Error("writeArtCacheFile", "Unable to create the art cache directory.", err)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".art-*")
+	if err != nil {
+		clog.Error("writeArtCacheFile", "Unable to create an art cache file.", err)
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		clog.Error("writeArtCacheFile", "Unable to write an art cache file.", err)
+	}
+	return err
+}
+
+// GET /api/art/{songID}?size=
+// Gets the album art of a song as an image. With size, the picture is scaled down to fit within
+// that many pixels, rounded up to one of the sizes in artSizes; without it the original is returned.
+// Responses carry an ETag and Last-Modified, so clients revalidate with If-None-Match or
+// If-Modified-Since and get 304 Not Modified while the art is unchanged.
+func (s *Server) Art(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		songID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		size, err := artSize(r.URL.Query().Get("size"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		art, err := s.artCached(songID, size)
+		if err == errNotFound || err == errNoArt {
+			w.WriteHeader(http.StatusNotFound) // 404 Not Found
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		file, err := os.Open(art.Path)
+		if err != nil {
+			clog.Error("Art", "Unable to open cached art.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		defer file.Close()
+		w.Header().Set("Content-Type", art.ContentType)
+		w.Header().Set("ETag", art.ETag)
+		w.Header().Set("Cache-Control", artCacheControl)
+		http.ServeContent(w, r, "", art.ModTime, file)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestArtSize(t *testing.T) {
+	for query, want := range map[string]int{"": 0, "1": 64, "64": 64, "65": 128, "300": 300, "2048": 2048} {
+		if got, err := artSize(query); err != nil || got != want {
+			t.Errorf("size %q is %d, %v; expected %d", query, got, err, want)
+		}
+	}
+	for _, query := range []string{"0", "-5", "big", "2049"} {
+		if _, err := artSize(query); err == nil {
+			t.Errorf("size %q was accepted", query)
+		}
+	}
+}
+
+func TestFolderImage(t *testing.T) {
+	dir := t.TempDir()
+	if got := folderImage(dir); got != "" {
+		t.Errorf("empty directory has folder image %q", got)
+	}
+	for _, name := range []string{"Front.PNG", "notes.jpg", "folder.jpg", "cover.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := folderImage(dir); got != filepath.Join(dir, "folder.jpg") {
+		t.Errorf("folder image is %q", got)
+	}
+	if !isFolderImage("/music/album/Cover.jpeg") || isFolderImage("/music/album/cover.mp3") || isFolderImage("/music/covers.jpg") {
+		t.Error("folder image names were misrecognised")
+	}
+}
+
+func TestArtResized(t *testing.T) {
+	s := NewServer(ServerConfig{ArtCacheDir: t.TempDir()})
+	t.Cleanup(s.Close)
+	original := artFile{Path: filepath.Join(s.Config.ArtCacheDir, "key-0.png"), ContentType: "image/png"}
+	if err := os.WriteFile(original.Path, testPNG(t, 1000, 500), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	art, err := s.artResized(original, "key", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(art.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config, err := png.DecodeConfig(file)
+	if err != nil || art.ContentType != "image/png" || config.Width != 256 || config.Height != 128 {
+		t.Errorf("resized art is %+v, %dx%d, %v", art, config.Width, config.Height, err)
+	}
+	if again, err := s.artResized(original, "key", 256); err != nil || again.Path != art.Path {
+		t.Errorf("cached variant was not reused: %+v, %v", again, err)
+	}
+	// Pictures smaller than the requested size are not scaled up, and are cached as they are.
+	art, err = s.artResized(original, "key", 2048)
+	if err != nil || art.ContentType != "image/png" {
+		t.Fatalf("small art is %+v, %v", art, err)
+	}
+	if cached, err := os.ReadFile(art.Path); err != nil || !bytes.Equal(cached, testPNG(t, 1000, 500)) {
+		t.Errorf("small art was resized: %v", err)
+	}
+	os.Remove(original.Path)
+	if again, err := s.artResized(original, "key", 2048); err != nil || again.Path != art.Path {
+		t.Errorf("small art was not served from the cache: %+v, %v", again, err)
+	}
+}
+
+// Clients asking for the same cache entry at once share one fill, while other entries are not held up.
+func TestArtFlights(t *testing.T) {
+	var flights artFlights
+	var fills atomic.Int32
+	release := make(chan struct{})
+	results := make(chan artFile, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			art, _ := flights.do("slow", func() (artFile, error) {
+				fills.Add(1)
+				<-release
+				return artFile{Path: "slow"}, nil
+			})
+			results <- art
+		}()
+	}
+	if art, _ := flights.do("fast", func() (artFile, error) { return artFile{Path: "fast"}, nil }); art.Path != "fast" {
+		t.Errorf("other entry returned %+v", art)
+	}
+	// Give both clients time to ask before the fill finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if art := <-results; art.Path != "slow" {
+			t.Errorf("waiting client got %+v", art)
+		}
+	}
+	if n := fills.Load(); n != 1 {
+		t.Errorf("entry was filled %d times", n)
+	}
+}
+
+// Songs indexed before art was stored have their art found by the first scan after upgrading.
+func TestArtMigrationFindsArt(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.MusicDir = t.TempDir()
+	path := filepath.Join(s.Config.MusicDir, "1.mp3")
+	writeTaggedMP3Frames(t, path, [2]string{"TIT2", "Thunderstruck"},
+		[2]string{"TPE1", "AC/DC"}, [2]string{"APIC", "image/png\x00\x03\x00" + string(testPNG(t, 100, 100))})
+	openTestPostgres(t, s)
+	id := indexBeforeMigration(t, s, 7, path)
+	if _, err := s.artCached(id, 0); err != nil {
+		t.Errorf("upgraded song has no art: %v", err)
+	}
+}
+
+func TestArt(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.MusicDir = t.TempDir()
+	s.Config.ArtCacheDir = t.TempDir()
+	// An APIC frame is written like a text frame: the encoding byte, then the MIME type,
+	// picture type and description, then the picture.
+	writeTaggedMP3Frames(t, filepath.Join(s.Config.MusicDir, "1.mp3"), [2]string{"TIT2", "Thunderstruck"},
+		[2]string{"TPE1", "AC/DC"}, [2]string{"APIC", "image/png\x00\x03\x00" + string(testPNG(t, 800, 800))})
+	// Both songs of the album share its folder image, which is stored once.
+	album := filepath.Join(s.Config.MusicDir, "Kind of Blue")
+	os.Mkdir(album, 0755)
+	writeTaggedMP3(t, filepath.Join(album, "1.mp3"), "So What", "Miles Davis")
+	writeTaggedMP3(t, filepath.Join(album, "2.mp3"), "Freddie Freeloader", "Miles Davis")
+	if err := os.WriteFile(filepath.Join(album, "Cover.png"), testPNG(t, 100, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "bare.mp3"), "Untitled", "Nobody")
+	connectTestPostgres(t, s)
+	routes := s.routes()
+	songID := func(title string) string {
+		t.Helper()
+		var id int
+		if err := s.DB.QueryRow("SELECT id FROM "+s.Config.PostgresTableName+" WHERE title = $1", title).Scan(&id); err != nil {
+			t.Fatalf("%s was not indexed: %v", title, err)
+		}
+		return strconv.Itoa(id)
+	}
+	artETag := func(path string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s returned %d", path, rec.Code)
+		}
+		return rec.Header().Get("ETag")
+	}
+	if a, b := artETag("/api/art/"+songID("So What")), artETag("/api/art/"+songID("Freddie Freeloader")); a != b {
+		t.Errorf("songs sharing a folder image have ETags %s and %s", a, b)
+	}
+	var stored int
+	s.DB.QueryRow("SELECT COUNT(*) FROM " + artTableName).Scan(&stored)
+	if stored != 2 {
+		t.Errorf("%d pictures stored, expected 2", stored)
+	}
+	// Art is served from the database, without reading the audio file again.
+	if err := os.Remove(filepath.Join(s.Config.MusicDir, "1.mp3")); err != nil {
+		t.Fatal(err)
+	}
+	thunderstruck := songID("Thunderstruck")
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/art/"+thunderstruck+"?size=300", nil))
+	config, err := png.DecodeConfig(rec.Body)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || err != nil || config.Width != 300 {
+		t.Fatalf("art returned %d %s, %dx%d, %v", rec.Code, rec.Header().Get("Content-Type"), config.Width, config.Height, err)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" || rec.Header().Get("Last-Modified") == "" || rec.Header().Get("Cache-Control") != artCacheControl {
+		t.Errorf("art caching headers are %v", rec.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/art/"+thunderstruck+"?size=300", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation returned %d", rec.Code)
+	}
+
+	// Clients asking for different sizes of art which is not cached yet each get their own size and ETag,
+	// though they share the fill of the original.
+	os.RemoveAll(s.Config.ArtCacheDir)
+	os.Mkdir(s.Config.ArtCacheDir, 0755)
+	var wg sync.WaitGroup
+	for query, size := range map[string]int{"": 0, "?size=300": 300} {
+		wg.Add(1)
+		go func(query string, size int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/art/"+thunderstruck+query, nil))
+			config, err := png.DecodeConfig(rec.Body)
+			width := size
+			if size == 0 {
+				width = 800
+			}
+			etag := rec.Header().Get("ETag")
+			if rec.Code != http.StatusOK || err != nil || config.Width != width || !strings.HasSuffix(etag, fmt.Sprintf(`-%d"`, size)) {
+				t.Errorf("size %d returned %d, %dx%d, ETag %s, %v", size, rec.Code, config.Width, config.Height, etag, err)
+			}
+		}(query, size)
+	}
+	wg.Wait()
+
+	for path, want := range map[string]int{
+		"/api/art/" + songID("Untitled"): http.StatusNotFound,
+		"/api/art/999999":                http.StatusNotFound,
+		"/api/art/abc":                   http.StatusBadRequest,
+		"/api/art/1?size=huge":           http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s returned %d, expected %d", path, rec.Code, want)
+		}
+	}
+}
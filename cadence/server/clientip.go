@@ -0,0 +1,139 @@
+// clientip.go
+// Client addresses of requests forwarded by trusted reverse proxies.
+//
+// Requests from a proxy listed in CSERVER_TRUSTED_PROXIES have their remote address replaced with
+// the client's, read from X-Forwarded-For, Forwarded or X-Real-IP in that order of preference.
+// Forwarding headers list every proxy a request passed through, so they are read from the nearest
+// proxy backwards, and the first address which is not a trusted proxy is the client. Anything before
+// it could have been written by the client itself and is ignored.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Parses a list of proxy networks and addresses such as "172.16.0.0/12, 10.0.0.2", separated by commas.
+func parseTrustedProxies(value string) (proxies []netip.Prefix, err error) {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy <%s>", field)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network <%s>", field)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.Config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the remote address of requests from trusted proxies with the address of the client
+// they forwarded, so that rate limits and logs see listeners rather than the proxy.
+func (s *Server) resolveClientAddress(next http.Handler) http.Handler {
+	if len(s.Config.TrustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		remote, err := netip.ParseAddr(host)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		remote = remote.Unmap()
+		if client := s.forwardedClient(remote, r.Header); client != remote {
+			r = r.Clone(r.Context())
+			r.RemoteAddr = net.JoinHostPort(client.String(), port)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the client a request from remote was forwarded for, or remote if it is not a trusted proxy.
+func (s *Server) forwardedClient(remote netip.Addr, header http.Header) netip.Addr {
+	if !s.trustedProxy(remote) {
+		return remote
+	}
+	hops := forwardingHops(header)
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseForwardedAddr(hops[i])
+		if err != nil {
+			// Obfuscated or malformed, so nothing further back can be trusted either.
+			return client
+		}
+		client = addr
+		if !s.trustedProxy(addr) {
+			return client
+		}
+	}
+	return client
+}
+
+// Returns the addresses a request was forwarded for, the client's first and the nearest proxy's last.
+func forwardingHops(header http.Header) (hops []string) {
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return hops
+	}
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, node, found := strings.Cut(strings.TrimSpace(pair), "=")
+					if found && strings.EqualFold(key, "for") {
+						hops = append(hops, node)
+					}
+				}
+			}
+		}
+		return hops
+	}
+	if value := header.Get("X-Real-IP"); value != "" {
+		return []string{value}
+	}
+	return nil
+}
+
+// Parses an address from a forwarding header, which may be quoted, bracketed and carry a port,
+// as in Forwarded: for="[2001:db8::17]:4711".
+func parseForwardedAddr(node string) (netip.Addr, error) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		return addr, err
+	}
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies(" 172.16.0.0/12, 10.0.0.2,,fd00::/8 ")
+	if err != nil || len(proxies) != 3 || proxies[1] != netip.MustParsePrefix("10.0.0.2/32") {
+		t.Errorf("proxies are %v, %v", proxies, err)
+	}
+	for _, value := range []string{"nginx", "10.0.0.0/33", "10.0.0.1,example.com"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("proxies %q were accepted", value)
+		}
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	s := NewServer(ServerConfig{})
+	s.Config.TrustedProxies, _ = parseTrustedProxies("172.16.0.0/12, 10.0.0.2")
+	for _, tt := range []struct {
+		name, remote string
+		header       http.Header
+		want         string
+	}{
+		{"untrusted remote", "198.51.100.7", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.7"},
+		{"no header", "172.18.0.2", http.Header{}, "172.18.0.2"},
+		{"x-forwarded-for", "172.18.0.2", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.1"},
+		{"proxy chain", "172.18.0.2", http.Header{"X-Forwarded-For": {"192.0.2.1, 10.0.0.2"}}, "192.0.2.1"},
+		{"spoofed by the client", "172.18.0.2", http.Header{"X-Forwarded-For": {"203.0.113.9, 192.0.2.1"}}, "192.0.2.1"},
+		{"repeated header", "172.18.0.2", http.Header{"X-Forwarded-For": {"203.0.113.9", "192.0.2.1"}}, "192.0.2.1"},
+		{"only proxies", "172.18.0.2", http.Header{"X-Forwarded-For": {"10.0.0.2"}}, "10.0.0.2"},
+		{"malformed", "172.18.0.2", http.Header{"X-Forwarded-For": {"192.0.2.1, unknown"}}, "172.18.0.2"},
+		{"forwarded", "172.18.0.2", http.Header{"Forwarded": {`for=192.0.2.1;proto=https, for="[2001:db8::17]:4711"`}}, "2001:db8::17"},
+		{"x-real-ip", "172.18.0.2", http.Header{"X-Real-Ip": {"192.0.2.1"}}, "192.0.2.1"},
+		{"x-forwarded-for first", "172.18.0.2", http.Header{"X-Real-Ip": {"203.0.113.9"}, "X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.1"},
+	} {
+		if got := s.forwardedClient(netip.MustParseAddr(tt.remote), tt.header); got.String() != tt.want {
+			t.Errorf("%s: client is %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	s.Config.TrustedProxies, _ = parseTrustedProxies("172.16.0.0/12")
+	s.setRateLimitPolicy("search", RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 1, Period: 30 * time.Second})
+	routes := s.routes()
+	search := func(client string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/search", strings.NewReader(`{"search": "year:abc"}`))
+		req.RemoteAddr = "172.18.0.2:40000"
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Listeners behind the proxy are limited separately rather than sharing its address.
+	if code := search("192.0.2.1"); code != http.StatusBadRequest {
+		t.Errorf("first listener's search returned %d", code)
+	}
+	if code := search("192.0.2.2"); code != http.StatusBadRequest {
+		t.Errorf("second listener's search returned %d", code)
+	}
+	if code := search("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("first listener's second search returned %d", code)
+	}
+}
+
+// Commands sent over a WebSocket are limited by the address of the client the proxy forwarded the upgrade for.
+func TestWebSocketBehindProxy(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	s.Config.TrustedProxies, _ = parseTrustedProxies("127.0.0.1")
+	s.setRateLimitPolicy("search", RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 1, Period: 30 * time.Second})
+	server := httptest.NewServer(s.routes())
+	defer server.Close()
+	search := func(client string) int {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws?events=none",
+			http.Header{"X-Forwarded-For": {client}})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		conn.WriteJSON(wsCommand{Type: "search", ID: "1", Search: "year:abc"})
+		return readWebSocket(t, conn).Status
+	}
+
+	if status := search("192.0.2.1"); status != http.StatusBadRequest {
+		t.Errorf("first listener's search returned %d", status)
+	}
+	if status := search("192.0.2.2"); status != http.StatusBadRequest {
+		t.Errorf("second listener's search returned %d", status)
+	}
+	if status := search("192.0.2.1"); status != http.StatusTooManyRequests {
+		t.Errorf("first listener's second search returned %d", status)
+	}
+}
@@ -4,150 +4,414 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/dhowden/tag"
 	"github.com/kenellorando/clog"
-	"github.com/lib/pq"
+	_ "github.com/lib/pq"
 )
 
-var dbp *sql.DB
-
-func postgresInit() (err error) {
+func (s *Server) postgresInit() (err error) {
 	// We wait a bit to give some leeway for Postgres to finish startup.
 	time.Sleep(2 * time.Second)
-	dsn := fmt.Sprintf("host='%s' port='%s' user='%s' password='%s' sslmode='%s'",
-		c.PostgresAddress, c.PostgresPort, c.PostgresUser, c.PostgresPassword, c.PostgresSSL)
-	dbp, err = sql.Open("postgres", dsn)
+	s.DB, err = sql.Open("postgres", s.postgresDSN())
 	if err != nil {
 		clog.Error("postgresInit", "Could not open connection to database.", err)
 		return err
 	}
-	err = dbp.Ping()
+	err = s.DB.Ping()
 	if err != nil {
 		clog.Error("postgresInit", "Could not successfully ping the metadata database.", err)
 		return err
 	}
-	// Enable fuzzystrmatch for levenshtein sorting.
-	// This enables the database to return results based on search similarity.
-	clog.Debug("postgresInit", "Enabling fuzzystrmatch extension...")
-	enableExtension := "CREATE EXTENSION fuzzystrmatch"
-	_, err = dbp.Exec(enableExtension)
+	// Enable pg_trgm for similarity ranking and indexed substring matching in search.
+	clog.Debug("postgresInit", "Enabling pg_trgm extension...")
+	_, err = s.DB.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm")
 	if err != nil {
-		if err.(*pq.Error).Code == "42710" {
-			// 42710 also indicates an existing Postgres instance configured by another Cadence instance is still running.
-			clog.Info("postgresInit", "fuzzystrmatch already enabled on metadata database.")
-		} else {
-			clog.Error("postgresInit", "Failed to enable fuzzystrmatch. Search may be degraded.", err)
-			return err
-		}
+		clog.Error("postgresInit", "Failed to enable pg_trgm. Search will not work.", err)
+		return err
 	}
 	return nil
 }
 
-func postgresPopulate() error {
-	dropDatabase := fmt.Sprintf("DROP DATABASE IF EXISTS %s", c.PostgresDBName)
-	createDatabase := fmt.Sprintf("CREATE DATABASE %s", c.PostgresDBName)
-	dropTable := fmt.Sprintf("DROP TABLE IF EXISTS %s", c.PostgresTableName)
-	createTable := fmt.Sprintf(`CREATE TABLE %s
-	(
-	   id serial PRIMARY KEY,
-	   title character varying(255),
-	   album character varying(255),
-	   artist character varying(255),
-	   genre character varying(255),
-	   year character varying(4),
-	   path character varying(510)
-	)
-	WITH (
-	   OIDS = FALSE
-	)`, c.PostgresTableName)
+// Returns the connection string built from the CSERVER_POSTGRES* settings.
+func (s *Server) postgresDSN() string {
+	return fmt.Sprintf("host='%s' port='%s' user='%s' password='%s' sslmode='%s'",
+		s.Config.PostgresAddress, s.Config.PostgresPort, s.Config.PostgresUser, s.Config.PostgresPassword, s.Config.PostgresSSL)
+}
+
+// Tracks one audio file as it is recorded in the metadata table.
+// ModTime and Size are cheap to compare on every scan; Hash is only
+// computed when either of them changes.
+type indexedFile struct {
+	ID      int
+	Path    string
+	ModTime time.Time
+	Size    int64
+	Hash    string
+	Reindex bool // Set by migrations which need the tags read again whether or not the file changed.
+}
+
+var audioExtensions = []string{".mp3", ".flac", ".ogg"}
+
+func isAudioFile(path string) bool {
+	for _, ext := range audioExtensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every file currently recorded in the metadata table, keyed by path.
+func (s *Server) postgresIndexedFiles() (files map[string]indexedFile, err error) {
+	selectStatement := fmt.Sprintf("SELECT id, path, COALESCE(mtime, 'epoch'), COALESCE(size, -1), COALESCE(hash, ''), reindex FROM %s",
+		s.Config.PostgresTableName)
+	rows, err := s.DB.Query(selectStatement)
+	if err != nil {
+		clog.Error("postgresIndexedFiles", "Failed to read indexed files.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	files = make(map[string]indexedFile)
+	for rows.Next() {
+		var f indexedFile
+		err = rows.Scan(&f.ID, &f.Path, &f.ModTime, &f.Size, &f.Hash, &f.Reindex)
+		if err != nil {
+			clog.Error("postgresIndexedFiles", "Data scan failed.", err)
+			return nil, err
+		}
+		files[f.Path] = f
+	}
+	return files, rows.Err()
+}
+
+// Returns the hex encoded SHA-256 of a file's contents.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	// Drop the database and rebuild it to start fresh.
-	clog.Debug("postgresPopulate", fmt.Sprintf("Deleting existing databases named <%s>...", c.PostgresDBName))
-	_, err := dbp.Exec(dropDatabase)
+// Reads tags and the duration of an audio file and writes them to the metadata table, along with
+// the file's artist, album and art. A row which already exists for the path keeps its ID.
+func (s *Server) postgresUpsertFile(f indexedFile) error {
+	file, err := os.Open(f.Path)
 	if err != nil {
-		clog.Error("postgresPopulate", "Failed to remove existing dbp. Skipping remaining autoconfig steps.", err)
 		return err
 	}
-	clog.Debug("postgresPopulate", fmt.Sprintf("Creating database <%s>...", c.PostgresDBName))
-	_, err = dbp.Exec(createDatabase)
+	defer file.Close()
+	tags, err := tag.ReadFrom(file)
 	if err != nil {
-		clog.Error("postgresPopulate", "Failed to create database. Skipping remaining autoconfig steps.", err)
 		return err
 	}
-	clog.Debug("postgresPopulate", fmt.Sprintf("Dropping table <%s>...", c.PostgresTableName))
-	_, err = dbp.Exec(dropTable)
+	// A file whose length cannot be worked out is still indexed, without a duration.
+	var duration sql.NullFloat64
+	if d, err := audioDuration(file); err != nil {
+		clog.Debug("postgresUpsertFile", fmt.Sprintf("Could not read the duration of <%s>: %v", f.Path, err))
+	} else {
+		duration = sql.NullFloat64{Float64: d.Seconds(), Valid: true}
+	}
+	art, artType := findArt(f.Path, tags)
+	track, trackTotal := tags.Track()
+	disc, discTotal := tags.Disc()
+
+	tx, err := s.DB.Begin()
 	if err != nil {
-		clog.Error("postgresPopulate", "Failed to drop table. Skipping remaining autoconfig steps.", err)
 		return err
 	}
-	clog.Debug("postgresPopulate", fmt.Sprintf("Creating table <%s>...", c.PostgresTableName))
-	_, err = dbp.Exec(createTable)
+	defer tx.Rollback()
+	artistID, err := upsertArtist(tx, tags.Artist())
 	if err != nil {
-		if err.(*pq.Error).Code == "42P07" {
-			// 42P10 indicates an existing metadata table configured by another Cadence instance is still running.
-			clog.Info("postgresInit", "Metadata database already exists")
-		} else {
-			clog.Error("postgresPopulate", "Failed to build database table!", err)
-			return err
-		}
+		return err
+	}
+	albumArtist := tags.AlbumArtist()
+	if albumArtist == "" {
+		albumArtist = tags.Artist()
+	}
+	albumArtistID, err := upsertArtist(tx, albumArtist)
+	if err != nil {
+		return err
+	}
+	albumID, err := upsertAlbum(tx, tags.Album(), albumArtistID, tags.Year())
+	if err != nil {
+		return err
+	}
+	artID, err := upsertArt(tx, art, artType)
+	if err != nil {
+		return err
+	}
+	upsert := fmt.Sprintf(`INSERT INTO %s (title, album, artist, genre, year, path, mtime, size, hash,
+	artist_id, album_id, album_artist, composer, track, track_total, disc, disc_total, duration, format, tag_format, art_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+	ON CONFLICT (path) DO UPDATE SET title = EXCLUDED.title, album = EXCLUDED.album, artist = EXCLUDED.artist,
+	genre = EXCLUDED.genre, year = EXCLUDED.year, mtime = EXCLUDED.mtime, size = EXCLUDED.size, hash = EXCLUDED.hash,
+	artist_id = EXCLUDED.artist_id, album_id = EXCLUDED.album_id, album_artist = EXCLUDED.album_artist,
+	composer = EXCLUDED.composer, track = EXCLUDED.track, track_total = EXCLUDED.track_total, disc = EXCLUDED.disc,
+	disc_total = EXCLUDED.disc_total, duration = EXCLUDED.duration, format = EXCLUDED.format, tag_format = EXCLUDED.tag_format,
+	art_id = EXCLUDED.art_id, reindex = false`,
+		s.Config.PostgresTableName)
+	_, err = tx.Exec(upsert, tags.Title(), tags.Album(), tags.Artist(), tags.Genre(), nullIfZero(tags.Year()), f.Path, f.ModTime, f.Size, f.Hash,
+		artistID, albumID, tags.AlbumArtist(), tags.Composer(), nullIfZero(track), nullIfZero(trackTotal),
+		nullIfZero(disc), nullIfZero(discTotal), duration, string(tags.FileType()), string(tags.Format()), artID)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	clog.Debug("postgresUpsertFile", fmt.Sprintf("Indexed: %s by %s", tags.Title(), tags.Artist()))
+	return nil
+}
+
+// Returns the ID of the named artist, adding it if it is new. An empty name has no artist.
+func upsertArtist(tx *sql.Tx, name string) (id sql.NullInt64, err error) {
+	if name == "" {
+		return id, nil
+	}
+	// The no-op update makes RETURNING give the ID of an existing row too.
+	err = tx.QueryRow(fmt.Sprintf(`INSERT INTO %s (name) VALUES ($1)
+	ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id`, artistsTableName), name).Scan(&id)
+	return id, err
+}
+
+// Returns the ID of an artist's album, adding it if it is new and filling in its year if it had none.
+// An album without a title or artist has no album.
+func upsertAlbum(tx *sql.Tx, title string, artistID sql.NullInt64, year int) (id sql.NullInt64, err error) {
+	if title == "" || !artistID.Valid {
+		return id, nil
+	}
+	err = tx.QueryRow(fmt.Sprintf(`INSERT INTO %s (title, artist_id, year) VALUES ($1, $2, $3)
+	ON CONFLICT (artist_id, title) DO UPDATE SET year = COALESCE(%s.year, EXCLUDED.year) RETURNING id`, albumsTableName, albumsTableName),
+		title, artistID, nullIfZero(year)).Scan(&id)
+	return id, err
+}
+
+// Tags report missing numbers as zero, which are stored as NULL.
+func nullIfZero(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+// Removes albums, artists and art which no song refers to any more.
+func (s *Server) postgresRemoveOrphans() error {
+	_, err := s.DB.Exec(fmt.Sprintf("DELETE FROM %s a WHERE NOT EXISTS (SELECT 1 FROM %s m WHERE m.art_id = a.id)",
+		artTableName, s.Config.PostgresTableName))
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(fmt.Sprintf("DELETE FROM %s al WHERE NOT EXISTS (SELECT 1 FROM %s m WHERE m.album_id = al.id)",
+		albumsTableName, s.Config.PostgresTableName))
+	if err != nil {
+		return err
 	}
+	_, err = s.DB.Exec(fmt.Sprintf(`DELETE FROM %s ar WHERE NOT EXISTS (SELECT 1 FROM %s m WHERE m.artist_id = ar.id)
+	AND NOT EXISTS (SELECT 1 FROM %s al WHERE al.artist_id = ar.id)`, artistsTableName, s.Config.PostgresTableName, albumsTableName))
+	return err
+}
+
+// Scans the whole music directory and brings the metadata table in line with it.
+// Only files which were added, changed, moved or removed since the last scan are written,
+// so song IDs stay stable and search keeps working while the scan runs.
+// The schema must already be migrated.
+func (s *Server) postgresPopulate() error {
 	clog.Debug("postgresPopulate", "Verifying music metadata directory is accessible...")
-	_, err = os.Stat(c.MusicDir)
+	_, err := os.Stat(s.Config.MusicDir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			clog.Error("postgresPopulate", "The configured target music directory was not found.", err)
-			return err
+		clog.Error("postgresPopulate", "The configured target music directory could not be accessed.", err)
+		return err
+	}
+	return s.postgresIndex([]string{s.Config.MusicDir})
+}
+
+// Reads the tags of every file in the music directory again, including files which have not
+// changed since the last scan. Rows are updated in place, so song IDs are kept.
+func (s *Server) postgresReindex() error {
+	_, err := os.Stat(s.Config.MusicDir)
+	if err != nil {
+		clog.Error("postgresReindex", "The configured target music directory could not be accessed.", err)
+		return err
+	}
+	return s.postgresIndexPaths([]string{s.Config.MusicDir}, true)
+}
+
+// Reindexes only the given files and directories. Paths which no longer exist
+// have their rows (and the rows of anything beneath them) removed from the index.
+func (s *Server) postgresIndex(roots []string) error {
+	return s.postgresIndexPaths(roots, false)
+}
+
+// Indexes the given files and directories. Unless rereadTags is set, files whose size,
+// modification time or contents have not changed keep the tags they were indexed with,
+// unless a migration flagged them for reindexing.
+func (s *Server) postgresIndexPaths(roots []string, rereadTags bool) error {
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+	start := time.Now()
+
+	// A folder image which was added, changed or removed changes the art of the audio files beside it.
+	rereadDirs := make(map[string]bool)
+	for _, root := range roots {
+		if isFolderImage(root) {
+			rereadDirs[filepath.Dir(root)] = true
+			roots = append(roots, filepath.Dir(root))
 		}
 	}
+	reread := func(path string) bool {
+		return rereadTags || rereadDirs[filepath.Dir(path)]
+	}
+	roots = collapsePaths(roots)
+	indexed, err := s.postgresIndexedFiles()
+	if err != nil {
+		clog.Error("postgresIndex", "Failed to load the existing library index.", err)
+		return err
+	}
 
-	insertInto := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s, %s) SELECT $1, $2, $3, $4, $5, $6", c.PostgresTableName, "title", "album", "artist", "genre", "year", "path")
-	clog.Debug("postgresPopulate", fmt.Sprintf("Extracting metadata from audio files in: <%s>", c.MusicDir))
-	err = filepath.Walk(c.MusicDir, func(path string, info os.FileInfo, err error) error {
+	seen := make(map[string]bool)
+	var changed []indexedFile
+	var unchanged int
+	for _, root := range roots {
+		clog.Debug("postgresIndex", fmt.Sprintf("Scanning audio files in: <%s>", root))
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					// The path was removed, any rows beneath it are cleaned up below.
+					return nil
+				}
+				clog.Error("postgresIndex", "Error during filepath walk", err)
+				return err
+			}
+			if info.IsDir() || !isAudioFile(path) {
+				return nil
+			}
+			seen[path] = true
+			f := indexedFile{Path: path, ModTime: info.ModTime(), Size: info.Size()}
+			if prev, ok := indexed[path]; ok && !reread(path) && !prev.Reindex && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+				unchanged++
+				return nil
+			}
+			f.Hash, err = hashFile(path)
+			if err != nil {
+				clog.Error("postgresIndex", fmt.Sprintf("A problem occured hashing <%s>.", path), err)
+				return nil
+			}
+			changed = append(changed, f)
+			return nil
+		})
 		if err != nil {
-			clog.Error("postgresPopulate", "Error during filepath walk", err)
+			clog.Error("postgresIndex", "Music library scan failed. The index was not modified.", err)
 			return err
 		}
-		clog.Debug("postgresPopulate", fmt.Sprintf("Populate analyzing file: <%s>", path))
-		if info.IsDir() {
-			clog.Debug("postgresPopulate", fmt.Sprintf("<%s> is a directory, skipping.", path))
-			return nil
+	}
+
+	// Rows whose file disappeared are either moves (the same content now lives at a new path)
+	// or deletions. Moves keep their song ID by having their path rewritten.
+	removed := make(map[int]indexedFile)
+	removedByHash := make(map[string][]indexedFile)
+	for path, f := range indexed {
+		if !seen[path] && underAnyPath(path, roots) {
+			removed[f.ID] = f
+			if f.Hash != "" {
+				removedByHash[f.Hash] = append(removedByHash[f.Hash], f)
+			}
 		}
-		extensions := []string{".mp3", ".flac", ".ogg"}
-		for _, ext := range extensions {
-			if strings.HasSuffix(path, ext) {
-				file, err := os.Open(path)
-				if err != nil {
-					clog.Error("postgresPopulate", fmt.Sprintf("A problem occured opening <%s>.", path), err)
-					return err
-				}
-				defer file.Close()
-				tags, err := tag.ReadFrom(file)
-				if err != nil {
-					clog.Error("postgresPopulate", fmt.Sprintf("A problem occured fetching tags from <%s>.", path), err)
-					return err
-				}
-				_, err = dbp.Exec(insertInto, tags.Title(), tags.Album(), tags.Artist(), tags.Genre(), tags.Year(), path)
-				if err != nil {
-					clog.Error("postgresPopulate", fmt.Sprintf("A problem occured populating metadata for <%s>.", path), err)
-					return err
+	}
+	var inserted, updated, moved, deleted int
+	for _, f := range changed {
+		prev, exists := indexed[f.Path]
+		if exists && !reread(f.Path) && !prev.Reindex && prev.Hash == f.Hash {
+			// Touched but not modified, only the file stats need refreshing.
+			_, err = s.DB.Exec(fmt.Sprintf("UPDATE %s SET mtime = $1, size = $2 WHERE id = $3", s.Config.PostgresTableName), f.ModTime, f.Size, prev.ID)
+			if err != nil {
+				clog.Error("postgresIndex", fmt.Sprintf("A problem occured updating file stats for <%s>.", f.Path), err)
+			}
+			continue
+		}
+		if candidates := removedByHash[f.Hash]; !exists && len(candidates) > 0 {
+			old := candidates[0]
+			removedByHash[f.Hash] = candidates[1:]
+			_, err = s.DB.Exec(fmt.Sprintf("UPDATE %s SET path = $1, mtime = $2, size = $3 WHERE id = $4", s.Config.PostgresTableName), f.Path, f.ModTime, f.Size, old.ID)
+			if err != nil {
+				clog.Error("postgresIndex", fmt.Sprintf("A problem occured recording the move of <%s> to <%s>.", old.Path, f.Path), err)
+				continue
+			}
+			delete(removed, old.ID)
+			moved++
+			if old.Reindex {
+				// The moved row now has this path, so the upsert reads its tags into it.
+				if err = s.postgresUpsertFile(f); err != nil {
+					clog.Error("postgresIndex", fmt.Sprintf("A problem occured populating metadata for <%s>.", f.Path), err)
 				}
-				clog.Debug("postgresPopulate", fmt.Sprintf("Populated: %s by %s", tags.Title(), tags.Artist()))
-				break
 			}
+			continue
+		}
+		err = s.postgresUpsertFile(f)
+		if err != nil {
+			clog.Error("postgresIndex", fmt.Sprintf("A problem occured populating metadata for <%s>.", f.Path), err)
+			continue
+		}
+		if exists {
+			updated++
+		} else {
+			inserted++
 		}
-		return nil
-	})
-	if err != nil {
-		clog.Error("postgresPopulate", "Music metadata database population failed, or may be incomplete.", err)
-		return err
 	}
-	clog.Info("postgresPopulate", "Database population completed.")
+	for _, f := range removed {
+		_, err = s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", s.Config.PostgresTableName), f.ID)
+		if err != nil {
+			clog.Error("postgresIndex", fmt.Sprintf("A problem occured removing <%s> from the index.", f.Path), err)
+			continue
+		}
+		deleted++
+	}
+	if updated > 0 || deleted > 0 {
+		if err = s.postgresRemoveOrphans(); err != nil {
+			clog.Error("postgresIndex", "A problem occured removing albums and artists with no songs left.", err)
+		}
+	}
+	s.metrics.indexDuration.Observe(time.Since(start).Seconds())
+	clog.Info("postgresIndex", fmt.Sprintf("Library scan completed in %v: %d added, %d updated, %d moved, %d removed, %d unchanged.",
+		time.Since(start).Round(time.Millisecond), inserted, updated, moved, deleted, unchanged))
 	return nil
 }
+
+// Drops duplicate paths and any path which is already covered by another path in the list.
+func collapsePaths(paths []string) []string {
+	cleaned := make([]string, 0, len(paths))
+	for _, p := range paths {
+		cleaned = append(cleaned, filepath.Clean(p))
+	}
+	sort.Strings(cleaned)
+	collapsed := make([]string, 0, len(cleaned))
+	for _, p := range cleaned {
+		if !underAnyPath(p, collapsed) {
+			collapsed = append(collapsed, p)
+		}
+	}
+	return collapsed
+}
+
+// Reports whether path is one of roots or lies beneath one of them.
+func underAnyPath(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
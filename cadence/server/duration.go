@@ -0,0 +1,251 @@
+// duration.go
+// Reading the length of MP3, FLAC and Ogg (Vorbis and Opus) audio from the stream headers.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var errUnknownDuration = errors.New("could not determine audio duration")
+
+// How far into a file the first MP3 frame is looked for, and how far from the end the last Ogg page is.
+const mp3SyncSearchLimit = 64 * 1024
+const oggLastPageSearchLimit = 64 * 1024
+
+// Returns the length of an audio file, recognised by its contents rather than its name.
+func audioDuration(r io.ReadSeeker) (time.Duration, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	start, err := skipID3v2(r)
+	if err != nil {
+		return 0, err
+	}
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return 0, errUnknownDuration
+	}
+	switch string(magic) {
+	case "fLaC":
+		return flacDuration(r)
+	case "OggS":
+		return oggDuration(r, start, size)
+	}
+	return mp3Duration(r, start, size)
+}
+
+// Seeks past an ID3v2 tag at the start of the file, if there is one, and returns where the audio begins.
+func skipID3v2(r io.ReadSeeker) (int64, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		_, err = r.Seek(0, io.SeekStart)
+		return 0, err
+	}
+	// The size is syncsafe: seven bits in each byte.
+	start := int64(10 + int(header[6])<<21 | int(header[7])<<14 | int(header[8])<<7 | int(header[9]))
+	if header[5]&0x10 != 0 {
+		start += 10 // Footer.
+	}
+	_, err := r.Seek(start, io.SeekStart)
+	return start, err
+}
+
+// Reads the total sample count and sample rate from the STREAMINFO block, which always comes first.
+func flacDuration(r io.Reader) (time.Duration, error) {
+	block := make([]byte, 4+34)
+	if _, err := io.ReadFull(r, block); err != nil || block[0]&0x7F != 0 {
+		return 0, errUnknownDuration
+	}
+	info := block[4:]
+	sampleRate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+	samples := int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:18]))
+	if sampleRate == 0 || samples == 0 {
+		return 0, errUnknownDuration
+	}
+	return samplesDuration(samples, sampleRate), nil
+}
+
+// Divides the granule position of the last page by the sample rate given in the first packet.
+func oggDuration(r io.ReadSeeker, start int64, size int64) (time.Duration, error) {
+	page := make([]byte, 27+255)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, page[:27]); err != nil {
+		return 0, errUnknownDuration
+	}
+	segments := int(page[26])
+	if _, err := io.ReadFull(r, page[27:27+segments]); err != nil {
+		return 0, errUnknownDuration
+	}
+	packet := make([]byte, 19)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, errUnknownDuration
+	}
+	var sampleRate, preSkip int64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		sampleRate = int64(binary.LittleEndian.Uint32(packet[12:16]))
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		// Opus granule positions always count at 48kHz.
+		sampleRate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return 0, errUnknownDuration
+	}
+
+	tailStart := size - oggLastPageSearchLimit
+	if tailStart < start {
+		tailStart = start
+	}
+	if _, err := r.Seek(tailStart, io.SeekStart); err != nil {
+		return 0, err
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || len(tail) < last+14 {
+		return 0, errUnknownDuration
+	}
+	granule := int64(binary.LittleEndian.Uint64(tail[last+6 : last+14]))
+	if sampleRate == 0 || granule <= preSkip {
+		return 0, errUnknownDuration
+	}
+	return samplesDuration(granule-preSkip, sampleRate), nil
+}
+
+// MPEG audio bitrates in kbit/s by bitrate index, for MPEG-1 layers I to III and MPEG-2/2.5 layers I and II/III.
+var mp3Bitrates = [5][16]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// MPEG audio sample rates by version (2.5, reserved, 2, 1) and sample rate index.
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{0, 0, 0},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+// The fields of an MPEG audio frame header needed to work out the length of a stream.
+type mp3Frame struct {
+	version         int // 3 for MPEG-1, 2 for MPEG-2 and 0 for MPEG-2.5.
+	layer           int // 1, 2 or 3.
+	bitrate         int // bit/s
+	sampleRate      int
+	mono            bool
+	samplesPerFrame int
+}
+
+// Parses a four byte MPEG audio frame header. Reports false if it is not a valid header.
+func parseMP3Frame(h []byte) (f mp3Frame, ok bool) {
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return f, false
+	}
+	f.version = int(h[1]>>3) & 3
+	f.layer = 4 - int(h[1]>>1)&3
+	bitrateIndex := int(h[2] >> 4)
+	sampleRateIndex := int(h[2]>>2) & 3
+	if f.version == 1 || f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return f, false
+	}
+	table := f.layer - 1
+	if f.version != 3 {
+		table = 3
+		if f.layer != 1 {
+			table = 4
+		}
+	}
+	f.bitrate = mp3Bitrates[table][bitrateIndex] * 1000
+	f.sampleRate = mp3SampleRates[f.version][sampleRateIndex]
+	f.mono = h[3]>>6 == 3
+	switch {
+	case f.layer == 1:
+		f.samplesPerFrame = 384
+	case f.layer == 3 && f.version != 3:
+		f.samplesPerFrame = 576
+	default:
+		f.samplesPerFrame = 1152
+	}
+	return f, true
+}
+
+// Uses the frame count of a Xing, Info or VBRI header in the first frame if there is one.
+// Otherwise the stream is taken to be constant bitrate, and its length worked out from its size.
+func mp3Duration(r io.ReadSeeker, start int64, size int64) (time.Duration, error) {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	head := make([]byte, mp3SyncSearchLimit)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, errUnknownDuration
+	}
+	head = head[:n]
+	offset := -1
+	var f mp3Frame
+	for i := 0; i+4 <= len(head); i++ {
+		var ok bool
+		if f, ok = parseMP3Frame(head[i : i+4]); ok {
+			offset = i
+			break
+		}
+	}
+	if offset < 0 {
+		return 0, errUnknownDuration
+	}
+	frame := head[offset:]
+
+	// The Xing header follows the side information, whose size depends on the version and channels.
+	xing := 4 + 32
+	switch {
+	case f.version == 3 && f.mono:
+		xing = 4 + 17
+	case f.version != 3 && f.mono:
+		xing = 4 + 9
+	case f.version != 3:
+		xing = 4 + 17
+	}
+	if len(frame) >= xing+12 {
+		tag := string(frame[xing : xing+4])
+		if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(frame[xing+4:])&1 != 0 {
+			frames := int64(binary.BigEndian.Uint32(frame[xing+8:]))
+			return samplesDuration(frames*int64(f.samplesPerFrame), int64(f.sampleRate)), nil
+		}
+	}
+	if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		frames := int64(binary.BigEndian.Uint32(frame[50:]))
+		return samplesDuration(frames*int64(f.samplesPerFrame), int64(f.sampleRate)), nil
+	}
+
+	audioBytes := size - start - int64(offset)
+	if _, err = r.Seek(size-128, io.SeekStart); err == nil {
+		id3v1 := make([]byte, 3)
+		if _, err = io.ReadFull(r, id3v1); err == nil && string(id3v1) == "TAG" {
+			audioBytes -= 128
+		}
+	}
+	if audioBytes <= 0 {
+		return 0, errUnknownDuration
+	}
+	return time.Duration(audioBytes * 8 * int64(time.Second) / int64(f.bitrate)), nil
+}
+
+func samplesDuration(samples int64, sampleRate int64) time.Duration {
+	return time.Duration(samples * int64(time.Second) / sampleRate)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Builds a FLAC stream holding only its STREAMINFO block.
+func testFLAC(sampleRate int, samples int64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | 0x02 // Stereo, the rest of the bits unused here.
+	info[13] = byte(samples>>32) & 0x0F
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+	b := append([]byte("fLaC"), 0x80, 0, 0, 34) // Last block, STREAMINFO, 34 bytes.
+	return append(b, info...)
+}
+
+// Builds an Ogg page holding the given packet and granule position.
+func testOggPage(granule uint64, packet []byte) []byte {
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	page[26] = 1
+	page = append(page, byte(len(packet)))
+	return append(page, packet...)
+}
+
+// Builds a constant bitrate MPEG-1 layer III stream of 128kbit/s stereo frames at 44.1kHz.
+func testMP3(frames int, xingFrames int) []byte {
+	header := []byte{0xFF, 0xFB, 0x90, 0x00}
+	frameSize := 144 * 128000 / 44100
+	var b bytes.Buffer
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, frameSize)
+		copy(frame, header)
+		if i == 0 && xingFrames > 0 {
+			copy(frame[36:], "Xing")
+			binary.BigEndian.PutUint32(frame[40:], 1)
+			binary.BigEndian.PutUint32(frame[44:], uint32(xingFrames))
+		}
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+func TestAudioDuration(t *testing.T) {
+	id3 := append([]byte("ID3\x03\x00\x00\x00\x00\x01\x00"), make([]byte, 128)...)   // A 128 byte tag.
+	vorbisHead := append([]byte("\x01vorbis\x00\x00\x00\x00\x02"), 0x44, 0xAC, 0, 0) // 44.1kHz
+	vorbisHead = append(vorbisHead, make([]byte, 16)...)
+	opusHead := append([]byte("OpusHead\x01\x02"), 0x38, 0x01) // 312 samples of pre-skip.
+	opusHead = append(opusHead, make([]byte, 7)...)
+
+	cases := []struct {
+		name string
+		file []byte
+		want time.Duration
+	}{
+		{"flac", testFLAC(44100, 44100*90), 90 * time.Second},
+		{"flac after id3", append(append([]byte{}, id3...), testFLAC(48000, 48000*3)...), 3 * time.Second},
+		{"vorbis", append(testOggPage(0, vorbisHead), testOggPage(44100*61, []byte{0})...), 61 * time.Second},
+		{"opus", append(testOggPage(0, opusHead), testOggPage(48000*5+312, []byte{0})...), 5 * time.Second},
+		{"mp3 xing", testMP3(2, 38281), 38281 * 1152 * time.Second / 44100},
+		{"mp3 cbr", testMP3(100, 0), time.Duration(100*417) * 8 * time.Second / 128000},
+		{"mp3 cbr after id3", append(append([]byte{}, id3...), testMP3(100, 0)...), time.Duration(100*417) * 8 * time.Second / 128000},
+	}
+	for _, c := range cases {
+		got, err := audioDuration(bytes.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	for _, bad := range [][]byte{{}, []byte("not audio at all"), []byte("fLaC"), testOggPage(0, []byte("unknown codec here"))} {
+		if _, err := audioDuration(bytes.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// fakes_test.go
+// In-process stand-ins for the Liquidsoap telnet server and the Icecast status page.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLiquidsoap speaks enough of Liquidsoap's telnet protocol for Cadence to push requests,
+// skip tracks and follow its request queue. Every command received is recorded.
+type fakeLiquidsoap struct {
+	listener net.Listener
+
+	mu              sync.Mutex
+	commands        []string
+	nextRID         int
+	queue           []int
+	metadata        map[int]map[string]string
+	dropConnections bool
+	replyDelay      time.Duration
+}
+
+func newFakeLiquidsoap(t *testing.T) *fakeLiquidsoap {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fake liquidsoap listen: %v", err)
+	}
+	f := &fakeLiquidsoap{listener: listener, metadata: make(map[int]map[string]string)}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeLiquidsoap) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Returns every command received so far, in order.
+func (f *fakeLiquidsoap) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// When set, connections are closed after each reply, like a Liquidsoap restart would.
+func (f *fakeLiquidsoap) DropConnections(drop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropConnections = drop
+}
+
+// Simulates Liquidsoap taking the next request from its queue and starting to play it.
+func (f *fakeLiquidsoap) PlayNext() (rid int, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.metadata {
+		if m["status"] == "playing" {
+			m["status"] = "destroyed"
+		}
+	}
+	if len(f.queue) == 0 {
+		return -1, false
+	}
+	rid, f.queue = f.queue[0], f.queue[1:]
+	f.metadata[rid]["status"] = "playing"
+	return rid, true
+}
+
+// Simulates a request from another source, such as a playlist, starting to play alongside any others.
+func (f *fakeLiquidsoap) PlayFile(filename string, title string, artist string) (rid int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rid = f.nextRID
+	f.nextRID++
+	f.metadata[rid] = map[string]string{"rid": strconv.Itoa(rid), "status": "playing", "filename": filename,
+		"title": title, "artist": artist}
+	return rid
+}
+
+// Delays every reply, after the command has been received and acted on, like a busy Liquidsoap.
+func (f *fakeLiquidsoap) SetReplyDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replyDelay = delay
+}
+
+func (f *fakeLiquidsoap) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeLiquidsoap) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		if command == "quit" {
+			fmt.Fprint(conn, "Bye!\r\n")
+			return
+		}
+		reply, drop := f.reply(command)
+		f.mu.Lock()
+		delay := f.replyDelay
+		f.mu.Unlock()
+		time.Sleep(delay)
+		for _, l := range reply {
+			fmt.Fprintf(conn, "%s\r\n", l)
+		}
+		fmt.Fprint(conn, "END\r\n")
+		if drop {
+			return
+		}
+	}
+}
+
+func (f *fakeLiquidsoap) reply(command string) (lines []string, drop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, command)
+	name, arg, _ := strings.Cut(command, " ")
+	switch {
+	case name == "request.push":
+		rid := f.nextRID
+		f.nextRID++
+		f.queue = append(f.queue, rid)
+		f.metadata[rid] = map[string]string{"rid": strconv.Itoa(rid), "status": "ready", "filename": arg}
+		lines = []string{strconv.Itoa(rid)}
+	case name == "request.queue":
+		rids := make([]string, 0, len(f.queue))
+		for _, rid := range f.queue {
+			rids = append(rids, strconv.Itoa(rid))
+		}
+		lines = []string{strings.Join(rids, " ")}
+	case name == "request.on_air":
+		rids := []string{}
+		for rid, m := range f.metadata {
+			if m["status"] == "playing" {
+				rids = append(rids, strconv.Itoa(rid))
+			}
+		}
+		lines = []string{strings.Join(rids, " ")}
+	case name == "request.metadata":
+		rid, _ := strconv.Atoi(arg)
+		for key, value := range f.metadata[rid] {
+			lines = append(lines, fmt.Sprintf("%s=%q", key, value))
+		}
+	case strings.HasSuffix(name, ".skip"):
+		lines = []string{"Done"}
+	case strings.HasSuffix(name, ".remaining"):
+		lines = []string{"42.50"}
+	case name == "var.get":
+		lines = []string{`"value"`}
+	case name == "var.set":
+		lines = []string{fmt.Sprintf("Variable %s set.", strings.Fields(arg)[0])}
+	case name == "version":
+		lines = []string{"Liquidsoap 2.2.1"}
+	case name == "help":
+		lines = []string{"Available commands:", "| help [<command>]", "| request.push <uri>", "| request.queue", "",
+			"Type \"help <command>\" for more information."}
+	default:
+		lines = []string{"ERROR: unknown command, type \"help\" to get a list of commands."}
+	}
+	return lines, f.dropConnections
+}
+
+// fakeIcecast serves a scripted status-json.xsl payload.
+type fakeIcecast struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func newFakeIcecast(t *testing.T) *fakeIcecast {
+	t.Helper()
+	f := &fakeIcecast{status: http.StatusOK}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status-json.xsl" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, f.body)
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeIcecast) Addr() string {
+	return strings.TrimPrefix(f.server.URL, "http://")
+}
+
+// Scripts a single mounted source playing the given song, as Icecast reports it.
+func (f *fakeIcecast) SetPlaying(title string, artist string, listeners int) {
+	f.SetStatus(http.StatusOK, fmt.Sprintf(`{"icestats":{"admin":"icemaster@localhost","host":"stream.example.com",
+		"server_id":"Icecast 2.4.4","source":{"artist":%q,"title":%q,"bitrate":192,"listeners":%d,
+		"listenurl":"http://stream.example.com:8000/cadence1","server_name":"cadence1","server_type":"application/ogg"}}}`,
+		artist, title, listeners))
+}
+
+// Scripts the raw status code and body of the status page.
+func (f *fakeIcecast) SetStatus(status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.body = status, body
+}
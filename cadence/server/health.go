@@ -0,0 +1,159 @@
+// health.go
+// Liveness and readiness checks for orchestrators.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+// How long each dependency has to answer a readiness check.
+const readyTimeout = 2 * time.Second
+
+// The result of checking one dependency.
+type ComponentStatus struct {
+	Name    string
+	Ready   bool
+	Error   string  `json:",omitempty"`
+	Latency float64 // Milliseconds the check took.
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Returns a check for every dependency the server needs to serve requests.
+func (s *Server) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{"postgres", s.checkPostgres},
+	}
+	if redis, ok := s.rateLimiter.(*RedisRateLimiter); ok {
+		checks = append(checks, readinessCheck{"redis", redis.Ping})
+	}
+	for _, st := range s.Stations {
+		st := st
+		checks = append(checks,
+			readinessCheck{"icecast:" + st.Name, func(ctx context.Context) error { return checkIcecast(ctx, st) }},
+			readinessCheck{"liquidsoap:" + st.Name, func(ctx context.Context) error { return checkLiquidsoap(ctx, st) }},
+		)
+	}
+	return checks
+}
+
+// Runs every readiness check at once, each limited to readyTimeout.
+func (s *Server) checkReadiness(ctx context.Context) (ready bool, components []ComponentStatus) {
+	checks := s.readinessChecks()
+	components = make([]ComponentStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			start := time.Now()
+			// Every check honours ctx, but stop waiting at the deadline regardless in case one blocks.
+			result := make(chan error, 1)
+			go func() { result <- c.check(ctx) }()
+			var err error
+			select {
+			case err = <-result:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			components[i] = ComponentStatus{Name: c.name, Ready: err == nil, Latency: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				components[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	ready = true
+	for _, c := range components {
+		ready = ready && c.Ready
+	}
+	return ready, components
+}
+
+// Checks that Postgres answers and the library table exists.
+func (s *Server) checkPostgres(ctx context.Context) error {
+	if s.DB == nil {
+		return errors.New("not connected")
+	}
+	var one int
+	err := s.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT 1 FROM %s LIMIT 1", s.Config.PostgresTableName)).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+func checkIcecast(ctx context.Context, st *Station) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+st.IcecastAddress+"/status-json.xsl", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status page returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func checkLiquidsoap(ctx context.Context, st *Station) error {
+	_, err := st.Liquidsoap.CommandContext(ctx, "version")
+	return err
+}
+
+// GET /ready
+// Checks every dependency: Postgres, Redis if rate limits are counted there, and each station's Icecast and Liquidsoap.
+// Gets 200 OK if all of them answered in time, otherwise 503 Service Unavailable, with a report of each.
+func (s *Server) Ready() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, components := s.checkReadiness(r.Context())
+		type Readiness struct {
+			Ready      bool
+			Components []ComponentStatus
+		}
+		jsonMarshal, err := json.Marshal(Readiness{Ready: ready, Components: components})
+		if err != nil {
+			clog.Error("Ready", "Failed to marshal readiness report.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if ready {
+			w.WriteHeader(http.StatusOK) // 200 OK
+		} else {
+			clog.Debug("Ready", fmt.Sprintf("Not ready: %+v", components))
+			w.WriteHeader(http.StatusServiceUnavailable) // 503 Service Unavailable
+		}
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error("Ready", "Failed to write response.", err)
+			return
+		}
+	}
+}
+
+// GET /live
+// Gets 200 OK as long as the process is serving requests. Dependencies are not checked; see /ready.
+func (s *Server) Live() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK) // 200 OK
+	}
+}
@@ -0,0 +1,132 @@
+// history.go
+// Play history: every song a station plays, kept in Postgres.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+const historyTableName = "play_history"
+
+// A single play of a song on a station. Ended is null while the song is still playing.
+// SongID is null if the song could not be found in the library.
+type PlayRecord struct {
+	ID        int
+	SongID    *int
+	Title     string
+	Artist    string
+	Started   time.Time
+	Ended     *time.Time
+	Listeners int
+	Requested bool
+}
+
+// Records that a station started playing a song at the given time, ending whatever it played before.
+// A track change is recorded once: if the station's open play is the same song started at the same time,
+// nothing changes. The same song started again, such as a repeated request, is a new play.
+func (s *Server) historyRecordPlay(st *Station, now RadioInfo, at time.Time) error {
+	if s.DB == nil {
+		return nil
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		clog.Error("historyRecordPlay", "Failed to begin transaction.", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var recorded bool
+	err = tx.QueryRow(fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE station = $1 AND ended_at IS NULL
+	AND song_id IS NOT DISTINCT FROM $2::integer AND started_at = $3)`, historyTableName),
+		st.Name, nullIfZero(now.Song.ID), at).Scan(&recorded)
+	if err != nil {
+		clog.Error("historyRecordPlay", "Failed to read the play history.", err)
+		return err
+	}
+	if recorded {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET ended_at = $2 WHERE station = $1 AND ended_at IS NULL", historyTableName), st.Name, at)
+	if err != nil {
+		clog.Error("historyRecordPlay", "Failed to end the previous play.", err)
+		return err
+	}
+
+	// The song is the library row resolved when the station started playing it, if there is one.
+	// It counts as a request if it is one Cadence handed to Liquidsoap.
+	insert := fmt.Sprintf(`INSERT INTO %s (station, song_id, title, artist, started_at, listeners, requested)
+	SELECT $1, $2::integer, $3, $4, $5, $6,
+	   EXISTS (SELECT 1 FROM %s q WHERE q.station = $1 AND q.song_id = $2::integer AND q.status IN ($7, $8))`,
+		historyTableName, queueTableName)
+	_, err = tx.Exec(insert, st.Name, nullIfZero(now.Song.ID), now.Song.Title, now.Song.Artist, at,
+		int(now.Listeners), queueStatusPushed, queueStatusPlaying)
+	if err != nil {
+		clog.Error("historyRecordPlay", "Failed to record the play.", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		clog.Error("historyRecordPlay", "Failed to commit the play history.", err)
+		return err
+	}
+	return nil
+}
+
+// Returns the plays of a station which overlap the time between since and until, newest first.
+// Either bound may be zero to leave it open. A cursor from a previous call continues where that page ended.
+// Returns the cursor for the next page, or an empty string if there are no more plays.
+func (s *Server) historyList(st *Station, since time.Time, until time.Time, limit int, cursor string) (plays []PlayRecord, next string, err error) {
+	after := 0
+	if cursor != "" {
+		after, err = strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	selectStatement := fmt.Sprintf(`SELECT id, song_id, title, artist, started_at, ended_at, listeners, requested FROM %s
+	WHERE station = $1
+	AND ($2::timestamptz IS NULL OR ended_at IS NULL OR ended_at >= $2)
+	AND ($3::timestamptz IS NULL OR started_at <= $3)
+	AND ($4 = 0 OR id < $4)
+	ORDER BY id DESC LIMIT $5`, historyTableName)
+	// Fetch one extra play to learn whether there is another page.
+	rows, err := s.DB.Query(selectStatement, st.Name, sql.NullTime{Time: since, Valid: !since.IsZero()},
+		sql.NullTime{Time: until, Valid: !until.IsZero()}, after, limit+1)
+	if err != nil {
+		clog.Error("historyList", "Failed to read the play history.", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	plays = []PlayRecord{}
+	for rows.Next() {
+		var p PlayRecord
+		var songID sql.NullInt64
+		var ended sql.NullTime
+		err = rows.Scan(&p.ID, &songID, &p.Title, &p.Artist, &p.Started, &ended, &p.Listeners, &p.Requested)
+		if err != nil {
+			clog.Error("historyList", "Data scan failed.", err)
+			return nil, "", err
+		}
+		if songID.Valid {
+			id := int(songID.Int64)
+			p.SongID = &id
+		}
+		if ended.Valid {
+			p.Ended = &ended.Time
+		}
+		plays = append(plays, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(plays) > limit {
+		plays = plays[:limit]
+		next = strconv.Itoa(plays[limit-1].ID)
+	}
+	return plays, next, nil
+}
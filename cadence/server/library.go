@@ -0,0 +1,343 @@
+// library.go
+// Browsing the library by artist, album, genre and year.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kenellorando/clog"
+)
+
+// Entries returned by a browse request when the client does not ask for a page size, and the most it may ask for.
+const libraryDefaultLimit = 100
+const libraryMaxLimit = 500
+
+var errInvalidSort = errors.New("invalid sort")
+
+type ArtistSummary struct {
+	Artist string
+	Albums int
+	Tracks int
+}
+
+type AlbumSummary struct {
+	ID     int
+	Album  string
+	Artist string
+	Year   int
+	Tracks int
+}
+
+type GenreSummary struct {
+	Genre  string
+	Tracks int
+}
+
+type YearSummary struct {
+	Year   int
+	Tracks int
+}
+
+// Returns the WHERE clause limiting a query of the metadata table, aliased m, to the songs a station may play,
+// using $1 for the station's library prefix.
+func (s *Server) libraryCondition() string {
+	return fmt.Sprintf("($1 = '' OR starts_with(m.path, $1)) AND m.id NOT IN (SELECT song_id FROM %s)", bansTableName)
+}
+
+// Picks the ORDER BY clause a browse request asked for with its sort parameter.
+// The first of the choices is the default.
+func librarySort(r *http.Request, choices [][2]string) (string, error) {
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		return choices[0][1], nil
+	}
+	for _, choice := range choices {
+		if choice[0] == sort {
+			return choice[1], nil
+		}
+	}
+	return "", fmt.Errorf("%w <%s>", errInvalidSort, sort)
+}
+
+func (s *Server) libraryArtists(st *Station, order string, limit int, offset int) (artists []ArtistSummary, total int, err error) {
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	selectStatement := fmt.Sprintf(`SELECT COALESCE(m.artist, '') AS name, COUNT(DISTINCT m.album_id), COUNT(*) AS tracks,
+	COUNT(*) OVER () FROM %s m WHERE %s GROUP BY 1 ORDER BY %s`, s.Config.PostgresTableName, s.libraryCondition(), order)
+	rows, err := s.DB.Query(selectStatement+" LIMIT $2 OFFSET $3", prefix, limit, offset)
+	if err != nil {
+		clog.Error("libraryArtists", "Failed to query artists.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	artists = []ArtistSummary{}
+	for rows.Next() {
+		var a ArtistSummary
+		if err = rows.Scan(&a.Artist, &a.Albums, &a.Tracks, &total); err != nil {
+			clog.Error("libraryArtists", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		artists = append(artists, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(artists) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, prefix); err != nil {
+			clog.Error("libraryArtists", "Failed to count artists.", err)
+			return nil, 0, err
+		}
+	}
+	return artists, total, nil
+}
+
+// Returns the albums holding tracks by the artist. Each album is credited to its album artist,
+// and its track count is of the tracks by the artist.
+func (s *Server) libraryArtistAlbums(st *Station, artist string, order string, limit int, offset int) (albums []AlbumSummary, total int, err error) {
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	selectStatement := fmt.Sprintf(`SELECT al.id, al.title AS name, ar.name AS artist, COALESCE(al.year, 0) AS year, COUNT(*) AS tracks,
+	COUNT(*) OVER () FROM %s m JOIN %s al ON al.id = m.album_id JOIN %s ar ON ar.id = al.artist_id
+	WHERE %s AND COALESCE(m.artist, '') = $2 GROUP BY al.id, ar.name ORDER BY %s`,
+		s.Config.PostgresTableName, albumsTableName, artistsTableName, s.libraryCondition(), order)
+	rows, err := s.DB.Query(selectStatement+" LIMIT $3 OFFSET $4", prefix, artist, limit, offset)
+	if err != nil {
+		clog.Error("libraryArtistAlbums", "Failed to query albums.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	albums = []AlbumSummary{}
+	for rows.Next() {
+		var a AlbumSummary
+		if err = rows.Scan(&a.ID, &a.Album, &a.Artist, &a.Year, &a.Tracks, &total); err != nil {
+			clog.Error("libraryArtistAlbums", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		albums = append(albums, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(albums) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, prefix, artist); err != nil {
+			clog.Error("libraryArtistAlbums", "Failed to count albums.", err)
+			return nil, 0, err
+		}
+	}
+	return albums, total, nil
+}
+
+// Returns the tracks of an album in disc and track order,
+// or errNotFound if the station has no tracks of the album.
+func (s *Server) libraryAlbumTracks(st *Station, id int, limit int, offset int) (tracks []SongData, total int, err error) {
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	var one int
+	err = s.DB.QueryRow(fmt.Sprintf("SELECT 1 FROM %s m WHERE %s AND m.album_id = $2 LIMIT 1",
+		s.Config.PostgresTableName, s.libraryCondition()), prefix, id).Scan(&one)
+	if err == sql.ErrNoRows {
+		return nil, 0, errNotFound
+	}
+	if err != nil {
+		clog.Error("libraryAlbumTracks", "Failed to look up album.", err)
+		return nil, 0, err
+	}
+	selectStatement := fmt.Sprintf(`SELECT m.id, %s, COUNT(*) OVER () FROM %s m WHERE %s AND m.album_id = $2
+	ORDER BY m.disc NULLS LAST, m.track NULLS LAST, m.path`, songColumns, s.Config.PostgresTableName, s.libraryCondition())
+	rows, err := s.DB.Query(selectStatement+" LIMIT $3 OFFSET $4", prefix, id, limit, offset)
+	if err != nil {
+		clog.Error("libraryAlbumTracks", "Failed to query tracks.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	tracks = []SongData{}
+	for rows.Next() {
+		var song SongData
+		targets := append([]interface{}{&song.ID}, songScanTargets(&song)...)
+		if err = rows.Scan(append(targets, &total)...); err != nil {
+			clog.Error("libraryAlbumTracks", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		tracks = append(tracks, song)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(tracks) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, prefix, id); err != nil {
+			clog.Error("libraryAlbumTracks", "Failed to count tracks.", err)
+			return nil, 0, err
+		}
+	}
+	return tracks, total, nil
+}
+
+func (s *Server) libraryGenres(st *Station, order string, limit int, offset int) (genres []GenreSummary, total int, err error) {
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	selectStatement := fmt.Sprintf(`SELECT COALESCE(m.genre, '') AS name, COUNT(*) AS tracks, COUNT(*) OVER ()
+	FROM %s m WHERE %s GROUP BY 1 ORDER BY %s`, s.Config.PostgresTableName, s.libraryCondition(), order)
+	rows, err := s.DB.Query(selectStatement+" LIMIT $2 OFFSET $3", prefix, limit, offset)
+	if err != nil {
+		clog.Error("libraryGenres", "Failed to query genres.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	genres = []GenreSummary{}
+	for rows.Next() {
+		var g GenreSummary
+		if err = rows.Scan(&g.Genre, &g.Tracks, &total); err != nil {
+			clog.Error("libraryGenres", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		genres = append(genres, g)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(genres) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, prefix); err != nil {
+			clog.Error("libraryGenres", "Failed to count genres.", err)
+			return nil, 0, err
+		}
+	}
+	return genres, total, nil
+}
+
+func (s *Server) libraryYears(st *Station, order string, limit int, offset int) (years []YearSummary, total int, err error) {
+	prefix := st.libraryPrefix(s.Config.MusicDir)
+	selectStatement := fmt.Sprintf(`SELECT COALESCE(m.year, 0) AS name, COUNT(*) AS tracks, COUNT(*) OVER ()
+	FROM %s m WHERE %s GROUP BY 1 ORDER BY %s`, s.Config.PostgresTableName, s.libraryCondition(), order)
+	rows, err := s.DB.Query(selectStatement+" LIMIT $2 OFFSET $3", prefix, limit, offset)
+	if err != nil {
+		clog.Error("libraryYears", "Failed to query years.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	years = []YearSummary{}
+	for rows.Next() {
+		var y YearSummary
+		if err = rows.Scan(&y.Year, &y.Tracks, &total); err != nil {
+			clog.Error("libraryYears", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		years = append(years, y)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(years) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, prefix); err != nil {
+			clog.Error("libraryYears", "Failed to count years.", err)
+			return nil, 0, err
+		}
+	}
+	return years, total, nil
+}
+
+// Serves one browse endpoint. Each is paged with limit and offset, reports the number of entries
+// in the X-Total-Count header, and may offer sort orders, of which the first is the default.
+func (s *Server) libraryHandler(caller string, sorts [][2]string,
+	query func(r *http.Request, order string, limit int, offset int) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePage(r, libraryDefaultLimit, libraryMaxLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		order := ""
+		if sorts != nil {
+			if order, err = librarySort(r, sorts); err != nil {
+				w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+				return
+			}
+		}
+		results, total, err := query(r, order, limit, offset)
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound) // 404 Not Found
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		jsonMarshal, err := json.Marshal(results)
+		if err != nil {
+			clog.Error(caller, "Failed to marshal library listing.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error(caller, "Failed to write response.", err)
+			return
+		}
+	}
+}
+
+// GET /api/{station}/library/artists?sort=name|tracks&limit=&offset=
+// Gets the artists in the library with their number of albums and tracks.
+func (s *Server) LibraryArtists(st *Station) http.HandlerFunc {
+	return s.libraryHandler("LibraryArtists", [][2]string{{"name", "name"}, {"tracks", "tracks DESC, name"}},
+		func(r *http.Request, order string, limit int, offset int) (interface{}, int, error) {
+			return s.libraryArtists(st, order, limit, offset)
+		})
+}
+
+// GET /api/{station}/library/artists/{name}/albums?sort=name|year|tracks&limit=&offset=
+// Gets the albums of an artist with their year and number of tracks. The name is path escaped.
+func (s *Server) LibraryArtistAlbums(st *Station, prefix string) http.HandlerFunc {
+	return s.libraryHandler("LibraryArtistAlbums", [][2]string{{"name", "name"}, {"year", "year, name"}, {"tracks", "tracks DESC, name"}},
+		func(r *http.Request, order string, limit int, offset int) (interface{}, int, error) {
+			// The name is taken from the escaped path so that names containing a slash can be requested.
+			rest := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+			escapedName, found := strings.CutSuffix(rest, "/albums")
+			if !found || escapedName == "" || strings.Contains(escapedName, "/") {
+				return nil, 0, errNotFound
+			}
+			name, err := url.PathUnescape(escapedName)
+			if err != nil {
+				return nil, 0, errNotFound
+			}
+			return s.libraryArtistAlbums(st, name, order, limit, offset)
+		})
+}
+
+// GET /api/{station}/library/albums/{id}/tracks?limit=&offset=
+// Gets the tracks of an album. Album IDs are given by /library/artists/{name}/albums.
+func (s *Server) LibraryAlbumTracks(st *Station, prefix string) http.HandlerFunc {
+	return s.libraryHandler("LibraryAlbumTracks", nil,
+		func(r *http.Request, order string, limit int, offset int) (interface{}, int, error) {
+			rest := strings.TrimPrefix(r.URL.Path, prefix)
+			idString, found := strings.CutSuffix(rest, "/tracks")
+			id, err := strconv.Atoi(idString)
+			if !found || err != nil {
+				return nil, 0, errNotFound
+			}
+			return s.libraryAlbumTracks(st, id, limit, offset)
+		})
+}
+
+// GET /api/{station}/library/genres?sort=name|tracks&limit=&offset=
+// Gets the genres in the library with their number of tracks.
+func (s *Server) LibraryGenres(st *Station) http.HandlerFunc {
+	return s.libraryHandler("LibraryGenres", [][2]string{{"name", "name"}, {"tracks", "tracks DESC, name"}},
+		func(r *http.Request, order string, limit int, offset int) (interface{}, int, error) {
+			return s.libraryGenres(st, order, limit, offset)
+		})
+}
+
+// GET /api/{station}/library/years?sort=year|tracks&limit=&offset=
+// Gets the years in the library with their number of tracks. Songs without a year are counted under 0.
+func (s *Server) LibraryYears(st *Station) http.HandlerFunc {
+	return s.libraryHandler("LibraryYears", [][2]string{{"year", "name"}, {"tracks", "tracks DESC, name"}},
+		func(r *http.Request, order string, limit int, offset int) (interface{}, int, error) {
+			return s.libraryYears(st, order, limit, offset)
+		})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLibraryBadRequests(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	routes := s.routes()
+	for path, want := range map[string]int{
+		"/api/library/artists?sort=random":       http.StatusBadRequest,
+		"/api/library/genres?limit=0":            http.StatusBadRequest,
+		"/api/library/years?offset=-1":           http.StatusBadRequest,
+		"/api/library/artists/a/b/albums":        http.StatusNotFound,
+		"/api/cadence1/library/artists/a/tracks": http.StatusNotFound,
+		"/api/library/albums/one/tracks":         http.StatusNotFound,
+		"/api/library/albums/1":                  http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s returned %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestLibraryBrowse(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3Frames(t, filepath.Join(s.Config.MusicDir, "1.mp3"),
+		[2]string{"TIT2", "Thunderstruck"}, [2]string{"TPE1", "AC/DC"}, [2]string{"TALB", "Live"}, [2]string{"TRCK", "2/2"})
+	writeTaggedMP3Frames(t, filepath.Join(s.Config.MusicDir, "2.mp3"),
+		[2]string{"TIT2", "Back in Black"}, [2]string{"TPE1", "AC/DC"}, [2]string{"TALB", "Live"}, [2]string{"TRCK", "1/2"})
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "3.mp3"), "So What", "Miles Davis")
+	connectTestPostgres(t, s)
+	routes := s.routes()
+
+	get := func(path string, v interface{}) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s returned %d %s", path, rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("X-Total-Count")
+	}
+	var artists []ArtistSummary
+	if total := get("/api/library/artists?sort=tracks&limit=1", &artists); total != "2" ||
+		len(artists) != 1 || artists[0].Artist != "AC/DC" || artists[0].Tracks != 2 {
+		t.Errorf("artists are %+v of %s", artists, total)
+	}
+	// A page past the last artist still reports how many there are.
+	if total := get("/api/library/artists?offset=5", &artists); total != "2" || len(artists) != 0 {
+		t.Errorf("artists past the last page are %+v of %s", artists, total)
+	}
+	var albums []AlbumSummary
+	get("/api/library/artists/AC%2FDC/albums", &albums)
+	if len(albums) != 1 || albums[0].Album != "Live" || albums[0].Artist != "AC/DC" || albums[0].Tracks != 2 {
+		t.Fatalf("albums are %+v", albums)
+	}
+	var tracks []SongData
+	get("/api/library/albums/"+strconv.Itoa(albums[0].ID)+"/tracks", &tracks)
+	if len(tracks) != 2 || tracks[0].Title != "Back in Black" || tracks[0].Track != 1 || tracks[0].Format != "MP3" {
+		t.Errorf("tracks are %+v", tracks)
+	}
+}
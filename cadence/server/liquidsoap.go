@@ -0,0 +1,375 @@
+// liquidsoap.go
+// Telnet client for the Liquidsoap server interface.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+const (
+	liquidsoapTimeout    = 5 * time.Second
+	liquidsoapPoolSize   = 2
+	liquidsoapMinBackoff = 500 * time.Millisecond
+	liquidsoapMaxBackoff = 30 * time.Second
+)
+
+var errLiquidsoapBackoff = errors.New("liquidsoap is unreachable, waiting before reconnecting")
+
+// LiquidsoapClient keeps a small pool of telnet connections to Liquidsoap open between commands.
+// Every command runs under a deadline, and failed connections are redialled with exponential backoff.
+type LiquidsoapClient struct {
+	address string
+	timeout time.Duration
+	idle    chan *liquidsoapConn
+
+	mu      sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+
+	// Number of commands which failed, for metrics.
+	failures atomic.Uint64
+}
+
+type liquidsoapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewLiquidsoapClient(address string, timeout time.Duration) *LiquidsoapClient {
+	return &LiquidsoapClient{
+		address: address,
+		timeout: timeout,
+		idle:    make(chan *liquidsoapConn, liquidsoapPoolSize),
+	}
+}
+
+// Returns an idle pooled connection, or dials a new one unless a previous dial failed recently.
+func (l *LiquidsoapClient) get(ctx context.Context) (lc *liquidsoapConn, reused bool, err error) {
+	select {
+	case lc = <-l.idle:
+		return lc, true, nil
+	default:
+	}
+	l.mu.Lock()
+	if time.Now().Before(l.retryAt) {
+		l.mu.Unlock()
+		return nil, false, errLiquidsoapBackoff
+	}
+	l.mu.Unlock()
+	dialer := net.Dialer{Timeout: l.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", l.address)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, which says nothing about whether Liquidsoap is reachable.
+		return nil, false, ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		if l.backoff == 0 {
+			l.backoff = liquidsoapMinBackoff
+		} else if l.backoff *= 2; l.backoff > liquidsoapMaxBackoff {
+			l.backoff = liquidsoapMaxBackoff
+		}
+		l.retryAt = time.Now().Add(l.backoff)
+		clog.Error("LiquidsoapClient", fmt.Sprintf("Failed to connect to audio source server, retrying in %v.", l.backoff), err)
+		return nil, false, err
+	}
+	l.backoff, l.retryAt = 0, time.Time{}
+	return &liquidsoapConn{conn: conn, reader: bufio.NewReader(conn)}, false, nil
+}
+
+// Returns a healthy connection to the pool, closing it if the pool is full.
+func (l *LiquidsoapClient) put(lc *liquidsoapConn) {
+	select {
+	case l.idle <- lc:
+	default:
+		lc.conn.Close()
+	}
+}
+
+// Closes all idle connections.
+func (l *LiquidsoapClient) Close() {
+	for {
+		select {
+		case lc := <-l.idle:
+			lc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Writes a command and reads its reply up to Liquidsoap's END terminator, giving up after timeout
+// or when ctx is done, whichever comes first.
+// sent reports whether the command was written, and answered whether any part of a reply was received.
+func (lc *liquidsoapConn) exchange(ctx context.Context, command string, timeout time.Duration) (lines []string, sent bool, answered bool, err error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = lc.conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if ctx.Done() != nil {
+		// Cancellation cuts the exchange short by moving the deadline to now. The watcher is
+		// waited for, so that it cannot touch the connection once it is back in the pool.
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				lc.conn.SetDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	_, err = fmt.Fprintf(lc.conn, "%s\n", command)
+	if err != nil {
+		return nil, false, false, err
+	}
+	for {
+		line, err := lc.reader.ReadString('\n')
+		if err != nil {
+			return lines, true, answered || line != "", err
+		}
+		answered = true
+		line = strings.TrimRight(line, "\r\n")
+		if line == "END" {
+			return lines, true, true, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Returns the context's error if it is done or its deadline has passed. The connection deadline
+// taken from the context can fire a moment before the context itself notices.
+func contextEnded(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// Reports whether a command failed because Liquidsoap had closed a pooled connection before it
+// arrived, so that it cannot have run. A timeout never qualifies: Liquidsoap may have run the
+// command and only been slow to reply, and running request.push or skip twice is not harmless.
+func staleConnection(err error, sent bool, answered bool) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	if !sent {
+		return true
+	}
+	return !answered && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET))
+}
+
+// Sends a single command to Liquidsoap and returns the lines of its reply.
+// A pooled connection which turns out to have been closed is replaced and the command retried once.
+func (l *LiquidsoapClient) Command(command string) (lines []string, err error) {
+	return l.CommandContext(context.Background(), command)
+}
+
+// Sends a command like Command, but stops waiting for Liquidsoap once ctx is done.
+// A command cut short by ctx returns its error and is not counted as a failure.
+func (l *LiquidsoapClient) CommandContext(ctx context.Context, command string) (lines []string, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		lc, reused, err := l.get(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				l.failures.Add(1)
+			}
+			return nil, err
+		}
+		lines, sent, answered, err := lc.exchange(ctx, command, l.timeout)
+		if err == nil {
+			l.put(lc)
+			clog.Debug("LiquidsoapClient", fmt.Sprintf("Reply to <%s> from audio source server: %v", command, lines))
+			return lines, nil
+		}
+		lc.conn.Close()
+		if err := contextEnded(ctx); err != nil {
+			return nil, err
+		}
+		if !reused || !staleConnection(err, sent, answered) {
+			clog.Error("LiquidsoapClient", fmt.Sprintf("Command <%s> to audio source server failed.", command), err)
+			l.failures.Add(1)
+			return nil, err
+		}
+		clog.Debug("LiquidsoapClient", "Pooled connection to audio source server was stale, reconnecting.")
+	}
+	l.failures.Add(1)
+	return nil, fmt.Errorf("liquidsoap command <%s> failed after reconnecting", command)
+}
+
+// Returns the number of commands which have failed since the client was created.
+func (l *LiquidsoapClient) Failures() uint64 {
+	return l.failures.Load()
+}
+
+// Takes the ID of a request queue and an absolute song path, and submits the path to be queued.
+// Returns the request ID Liquidsoap assigned to it.
+func (l *LiquidsoapClient) Push(queue string, path string) (rid int, err error) {
+	lines, err := l.Command(queue + ".push " + path)
+	if err != nil {
+		return -1, err
+	}
+	if len(lines) < 1 {
+		return -1, fmt.Errorf("empty reply to %s.push", queue)
+	}
+	rid, err = strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return -1, fmt.Errorf("unexpected reply to %s.push: %q", queue, lines[0])
+	}
+	clog.Info("LiquidsoapClient", fmt.Sprintf("Audio source server accepted <%s> as request <%d>.", path, rid))
+	return rid, nil
+}
+
+// Takes the ID of a request queue. Returns the IDs of requests waiting in it.
+func (l *LiquidsoapClient) Queue(queue string) (rids []int, err error) {
+	return l.requestIDs(queue + ".queue")
+}
+
+// Returns the IDs of the requests being played, from any source.
+func (l *LiquidsoapClient) OnAir() (rids []int, err error) {
+	return l.requestIDs("request.on_air")
+}
+
+// Runs a command whose reply is a list of request IDs separated by spaces.
+func (l *LiquidsoapClient) requestIDs(command string) (rids []int, err error) {
+	lines, err := l.Command(command)
+	if err != nil {
+		return nil, err
+	}
+	rids = []int{}
+	for _, line := range lines {
+		for _, field := range strings.Fields(line) {
+			rid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected request ID in reply to %s: %q", command, field)
+			}
+			rids = append(rids, rid)
+		}
+	}
+	return rids, nil
+}
+
+// Takes a Liquidsoap request ID.
+// Returns the metadata Liquidsoap holds for the request, such as its status and filename.
+func (l *LiquidsoapClient) Metadata(rid int) (metadata map[string]string, err error) {
+	lines, err := l.Command(fmt.Sprintf("request.metadata %d", rid))
+	if err != nil {
+		return nil, err
+	}
+	return parseLiquidsoapMetadata(lines), nil
+}
+
+// Parses key="value" lines as printed by Liquidsoap's metadata commands.
+func parseLiquidsoapMetadata(lines []string) map[string]string {
+	metadata := make(map[string]string)
+	for _, line := range lines {
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// Returns the value of an interactive variable.
+func (l *LiquidsoapClient) VarGet(name string) (value string, err error) {
+	lines, err := l.Command("var.get " + name)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) < 1 {
+		return "", fmt.Errorf("empty reply to var.get %s", name)
+	}
+	value = lines[0]
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return value, nil
+}
+
+// Sets an interactive variable. Returns Liquidsoap's confirmation message.
+func (l *LiquidsoapClient) VarSet(name string, value string) (message string, err error) {
+	lines, err := l.Command(fmt.Sprintf("var.set %s = %s", name, value))
+	if err != nil {
+		return "", err
+	}
+	message = strings.Join(lines, "\n")
+	// Liquidsoap confirms with "Variable <name> set." and otherwise explains why it refused.
+	if !strings.HasSuffix(message, " set.") {
+		return message, fmt.Errorf("var.set %s rejected: %s", name, message)
+	}
+	return message, nil
+}
+
+// Takes the ID of an output. Returns the seconds remaining in the track it is playing.
+func (l *LiquidsoapClient) Remaining(output string) (remaining float64, err error) {
+	lines, err := l.Command(output + ".remaining")
+	if err != nil {
+		return -1, err
+	}
+	if len(lines) < 1 {
+		return -1, fmt.Errorf("empty reply to %s.remaining", output)
+	}
+	remaining, err = strconv.ParseFloat(strings.TrimSpace(lines[0]), 64)
+	if err != nil {
+		return -1, fmt.Errorf("unexpected reply to %s.remaining: %q", output, lines[0])
+	}
+	return remaining, nil
+}
+
+// Takes the ID of an output and skips the track it is playing.
+func (l *LiquidsoapClient) Skip(output string) (message string, err error) {
+	lines, err := l.Command(output + ".skip")
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Returns the names of all commands the Liquidsoap server accepts.
+func (l *LiquidsoapClient) Help() (commands []string, err error) {
+	lines, err := l.Command("help")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "| ") {
+			continue
+		}
+		if fields := strings.Fields(strings.TrimPrefix(line, "| ")); len(fields) > 0 {
+			commands = append(commands, fields[0])
+		}
+	}
+	return commands, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLiquidsoapClientPush(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	client := NewLiquidsoapClient(fake.Addr(), time.Second)
+	defer client.Close()
+
+	for want := 0; want < 3; want++ {
+		rid, err := client.Push("request", "/music/song.mp3")
+		if err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		if rid != want {
+			t.Errorf("Push returned request ID %d, want %d", rid, want)
+		}
+	}
+	rids, err := client.Queue("request")
+	if err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+	if !reflect.DeepEqual(rids, []int{0, 1, 2}) {
+		t.Errorf("Queue returned %v, want [0 1 2]", rids)
+	}
+	metadata, err := client.Metadata(1)
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if metadata["filename"] != "/music/song.mp3" || metadata["status"] != "ready" {
+		t.Errorf("Metadata returned %v", metadata)
+	}
+}
+
+func TestLiquidsoapClientCommands(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	client := NewLiquidsoapClient(fake.Addr(), time.Second)
+	defer client.Close()
+
+	if _, err := client.Skip("cadence1"); err != nil {
+		t.Errorf("Skip: %v", err)
+	}
+	if remaining, err := client.Remaining("cadence1"); err != nil || remaining != 42.5 {
+		t.Errorf("Remaining returned %v, %v", remaining, err)
+	}
+	if value, err := client.VarGet("volume"); err != nil || value != "value" {
+		t.Errorf("VarGet returned %q, %v", value, err)
+	}
+	if _, err := client.VarSet("volume", "0.5"); err != nil {
+		t.Errorf("VarSet: %v", err)
+	}
+	commands, err := client.Help()
+	if err != nil {
+		t.Fatalf("Help: %v", err)
+	}
+	if !reflect.DeepEqual(commands, []string{"help", "request.push", "request.queue"}) {
+		t.Errorf("Help returned %v", commands)
+	}
+	want := []string{"cadence1.skip", "cadence1.remaining", "var.get volume", "var.set volume = 0.5", "help"}
+	if got := fake.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("fake received %v, want %v", got, want)
+	}
+}
+
+func TestLiquidsoapClientReconnects(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	fake.DropConnections(true)
+	client := NewLiquidsoapClient(fake.Addr(), time.Second)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Queue("request"); err != nil {
+			t.Fatalf("Queue after dropped connection %d: %v", i, err)
+		}
+	}
+	if got := len(fake.Commands()); got != 3 {
+		t.Errorf("fake received %d commands, want 3", got)
+	}
+}
+
+// A command which timed out may still have run, so it is not sent again.
+func TestLiquidsoapClientTimeoutNotRetried(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	client := NewLiquidsoapClient(fake.Addr(), 200*time.Millisecond)
+	defer client.Close()
+
+	if _, err := client.Push("request", "/music/song.mp3"); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	fake.SetReplyDelay(time.Second)
+	if _, err := client.Push("request", "/music/song.mp3"); err == nil {
+		t.Fatal("Push succeeded past its deadline")
+	}
+	if got := len(fake.Commands()); got != 2 {
+		t.Errorf("fake received %d commands, want 2", got)
+	}
+}
+
+// A command whose context ends stops waiting at once, and the abandoned command is not a failure.
+func TestLiquidsoapClientContext(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	fake.SetReplyDelay(time.Second)
+	client := NewLiquidsoapClient(fake.Addr(), 5*time.Second)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.CommandContext(ctx, "version"); err != context.DeadlineExceeded {
+		t.Errorf("CommandContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("CommandContext returned after %v", elapsed)
+	}
+	if failures := client.Failures(); failures != 0 {
+		t.Errorf("%d failures counted", failures)
+	}
+}
+
+func TestLiquidsoapClientBacksOff(t *testing.T) {
+	fake := newFakeLiquidsoap(t)
+	address := fake.Addr()
+	fake.listener.Close()
+	client := NewLiquidsoapClient(address, time.Second)
+
+	if _, err := client.Queue("request"); err == nil {
+		t.Fatal("Queue succeeded against a closed server")
+	}
+	if _, err := client.Queue("request"); err != errLiquidsoapBackoff {
+		t.Errorf("second Queue returned %v, want %v", err, errLiquidsoapBackoff)
+	}
+}
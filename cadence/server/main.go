@@ -3,14 +3,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/kenellorando/clog"
 )
 
-var c = ServerConfig{}
-
 type ServerConfig struct {
 	Version           string
 	RootPath          string
@@ -33,9 +33,19 @@ type ServerConfig struct {
 	RedisPort         string
 	WhitelistPath     string
 	DevMode           bool
+	AdminToken        string
+	AdminPasswordHash string
+	ArtCacheDir       string
+	TrackSecret       string
+	RateLimitBackend  string
+	RateLimitPolicies map[string]RateLimitPolicy
+	TrustedProxies    []netip.Prefix
+	RequestRules      RequestRules
+	Stations          []StationConfig
 }
 
 func main() {
+	c := ServerConfig{}
 	c.Version = os.Getenv("CSERVER_VERSION")
 	c.RootPath = os.Getenv("CSERVER_ROOTPATH")
 	c.LogLevel, _ = strconv.Atoi(os.Getenv("CSERVER_LOGLEVEL"))
@@ -57,19 +67,54 @@ func main() {
 	c.RedisPort = os.Getenv("CSERVER_REDISPORT")
 	c.WhitelistPath = os.Getenv("CSERVER_WHITELIST_PATH")
 	c.DevMode, _ = strconv.ParseBool(os.Getenv("CSERVER_DEVMODE"))
+	c.AdminToken = os.Getenv("CSERVER_ADMIN_TOKEN")
+	c.AdminPasswordHash = os.Getenv("CSERVER_ADMIN_PASSWORDHASH")
+	c.ArtCacheDir = os.Getenv("CSERVER_ARTCACHEDIR")
+	c.TrackSecret = os.Getenv("CSERVER_TRACK_SECRET")
+	c.RateLimitBackend = os.Getenv("CSERVER_RATELIMIT_BACKEND")
+	if c.ArtCacheDir == "" {
+		c.ArtCacheDir = filepath.Join(os.TempDir(), "cadence-art")
+	}
 
 	clog.Level(c.LogLevel)
 	clog.Debug("main", fmt.Sprintf("Cadence Logger initialized to level <%v>.", c.LogLevel))
 
-	if postgresInit() == nil {
-		if postgresPopulate() != nil {
-			clog.Warn("main", "Initial database population failed.")
+	var err error
+	c.Stations, err = stationConfigsFromEnv(c)
+	if err != nil {
+		clog.Fatal("main", "Station configuration is invalid.", err)
+	}
+	c.RateLimitPolicies, err = rateLimitPoliciesFromEnv(c)
+	if err != nil {
+		clog.Fatal("main", "Rate limit configuration is invalid.", err)
+	}
+	c.TrustedProxies, err = parseTrustedProxies(os.Getenv("CSERVER_TRUSTED_PROXIES"))
+	if err != nil {
+		clog.Fatal("main", "Trusted proxy configuration is invalid.", err)
+	}
+	c.RequestRules, err = requestRulesFromEnv()
+	if err != nil {
+		clog.Fatal("main", "Request rule configuration is invalid.", err)
+	}
+
+	s := NewServer(c)
+	if s.postgresInit() == nil {
+		if s.postgresMigrate() != nil {
+			clog.Warn("main", "Database migrations failed. The library, request queue and history are unavailable.")
+		} else {
+			if s.postgresPopulate() != nil {
+				clog.Warn("main", "Initial database population failed.")
+			}
+			for _, st := range s.Stations {
+				go s.requestQueueMonitor(st)
+			}
 		}
 	}
-	go redisInit()
-	go filesystemMonitor()
-	go icecastMonitor()
+	go s.filesystemMonitor()
+	for _, st := range s.Stations {
+		go s.icecastMonitor(st)
+	}
 
 	clog.Info("main", fmt.Sprintf("Starting Cadence on port <%s>.", c.Port))
-	clog.Fatal("main", "Cadence failed to start!", http.ListenAndServe(c.Port, routes()))
+	clog.Fatal("main", "Cadence failed to start!", http.ListenAndServe(c.Port, s.routes()))
 }
@@ -0,0 +1,160 @@
+// metrics.go
+// Prometheus metrics for the server, library and streams, served on /metrics.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kenellorando/clog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the instruments the server updates as it runs. Values which can be read
+// from the server's state, such as listener counts, are collected when scraped instead.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpDuration        *prometheus.HistogramVec
+	rateLimitRejections *prometheus.CounterVec
+	icecastPollFailures *prometheus.CounterVec
+	icecastPollDuration *prometheus.HistogramVec
+	indexDuration       prometheus.Histogram
+}
+
+func NewMetrics(s *Server) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cadence_http_requests_total",
+			Help: "HTTP requests served, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cadence_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		rateLimitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cadence_ratelimit_rejections_total",
+			Help: "Requests rejected by a rate limiter, by limiter.",
+		}, []string{"limiter"}),
+		icecastPollFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cadence_icecast_poll_failures_total",
+			Help: "Icecast status polls which failed, by station.",
+		}, []string{"station"}),
+		icecastPollDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cadence_icecast_poll_duration_seconds",
+			Help:    "Time taken to poll Icecast status, by station.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"station"}),
+		indexDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cadence_library_index_duration_seconds",
+			Help:    "Time taken to scan and index the music library.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+		}),
+	}
+	m.registry.MustRegister(
+		m.httpRequests, m.httpDuration, m.rateLimitRejections, m.icecastPollFailures, m.icecastPollDuration, m.indexDuration,
+		serverCollector{s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+var (
+	liquidsoapFailuresDesc = prometheus.NewDesc("cadence_liquidsoap_command_failures_total",
+		"Liquidsoap commands which failed, by station.", []string{"station"}, nil)
+	sseClientsDesc = prometheus.NewDesc("cadence_sse_clients",
+		"Clients connected to the radio data event stream, by station.", []string{"station"}, nil)
+	listenersDesc = prometheus.NewDesc("cadence_listeners",
+		"Current Icecast listener count, by station. -1 while Icecast is unreachable.", []string{"station"}, nil)
+	librarySongsDesc = prometheus.NewDesc("cadence_library_songs",
+		"Songs in the library index.", nil, nil)
+)
+
+// Collects metrics from the server's state at scrape time.
+type serverCollector struct {
+	s *Server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- liquidsoapFailuresDesc
+	ch <- sseClientsDesc
+	ch <- listenersDesc
+	ch <- librarySongsDesc
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.s.Stations {
+		ch <- prometheus.MustNewConstMetric(liquidsoapFailuresDesc, prometheus.CounterValue, float64(st.Liquidsoap.Failures()), st.Name)
+		ch <- prometheus.MustNewConstMetric(sseClientsDesc, prometheus.GaugeValue, float64(st.SSE.ConsumersCount()), st.Name)
+		ch <- prometheus.MustNewConstMetric(listenersDesc, prometheus.GaugeValue, st.nowPlaying().Listeners, st.Name)
+	}
+	if c.s.DB == nil {
+		return
+	}
+	var songs int
+	err := c.s.DB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", c.s.Config.PostgresTableName)).Scan(&songs)
+	if err != nil {
+		clog.Debug("serverCollector", fmt.Sprintf("Unable to count library songs: %v", err))
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(librarySongsDesc, prometheus.GaugeValue, float64(songs))
+}
+
+// GET /metrics
+// Serves metrics in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// Counts and times every request by the route pattern which served it.
+func (s *Server) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r)
+		s.metrics.httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		s.metrics.httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+	})
+}
+
+// Records the status code written by a handler.
+// Responses may still be streamed and connections hijacked through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
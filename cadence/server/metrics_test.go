@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	server := httptest.NewServer(s.routes())
+	t.Cleanup(server.Close)
+
+	fakeIC.SetPlaying("Song", "Artist", 7)
+	var prev RadioInfo
+	s.icecastCheck(s.defaultStation(), &prev)
+	fakeIC.SetStatus(http.StatusInternalServerError, "")
+	s.icecastCheck(s.defaultStation(), &prev)
+
+	for _, path := range []string{"/api/version", "/api/cadence1/bitrate", "/no/such/route"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The event stream runs until the client goes away, and is only recorded once it has.
+	resp, err := http.Get(server.URL + "/api/radiodata/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var body []byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err = http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(body), `route="/api/radiodata/sse"`) {
+			break
+		}
+	}
+	for _, want := range []string{
+		`cadence_http_requests_total{code="200",method="GET",route="/api/version"} 1`,
+		`cadence_http_requests_total{code="200",method="GET",route="/api/cadence1/bitrate"} 1`,
+		`cadence_http_requests_total{code="404",method="GET",route="/"} 1`,
+		`cadence_http_request_duration_seconds_count{method="GET",route="/api/radiodata/sse"} 1`,
+		`cadence_icecast_poll_failures_total{station="cadence1"} 1`,
+		`cadence_icecast_poll_duration_seconds_count{station="cadence1"} 2`,
+		`cadence_listeners{station="cadence1"} -1`,
+		`cadence_liquidsoap_command_failures_total{station="cadence1"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+}
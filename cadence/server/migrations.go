@@ -0,0 +1,320 @@
+// migrations.go
+// Versioned changes to the database schema, applied in order at startup.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+const migrationsTableName = "schema_migrations"
+const artistsTableName = "artists"
+const albumsTableName = "albums"
+
+// Identifies the advisory lock held while migrating: "cadence" in ASCII.
+const migrationLockKey int64 = 0x636164656e6365
+
+// One versioned change to the schema. Statements are built from the server's configuration,
+// since the metadata table name is configurable.
+type migration struct {
+	version     int
+	description string
+	statements  func(s *Server) []string
+}
+
+// Every migration, in the order they are applied. Applied migrations must never be edited or
+// reordered; changes to the schema are made by appending a new one. Migrations must not drop
+// tables or columns holding data which cannot be rebuilt from the music library.
+var migrations = []migration{
+	{1, "Create the metadata table", migrateMetadataTable},
+	{2, "Normalize artists and albums and add track columns", migrateNormalizedLibrary},
+	{3, "Create the request queue table", migrateRequestQueue},
+	{4, "Create the ban and audit log tables", migrateAdminTables},
+	{5, "Create the play history table", migratePlayHistory},
+	{6, "Create the listener samples table", migrateListenerSamples},
+	{7, "Store album art found while indexing", migrateArt},
+}
+
+// The metadata table as it was before migrations were versioned. Every statement tolerates
+// a table created by an older release, whose rows are kept.
+func migrateMetadataTable(s *Server) []string {
+	t := s.Config.PostgresTableName
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   title character varying(255),
+		   album character varying(255),
+		   artist character varying(255),
+		   genre character varying(255),
+		   year character varying(4),
+		   path character varying(510),
+		   mtime timestamp with time zone,
+		   size bigint,
+		   hash character(64)
+		)`, t),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS mtime timestamp with time zone", t),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS size bigint", t),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS hash character(64)", t),
+		fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_path_key ON %s (path)", t, t),
+	}
+	return append(statements, searchIndexStatements(t)...)
+}
+
+// Moves artists and albums into their own tables, stores the year as an integer, and adds the
+// track columns read from tags. Existing rows are flagged for reindexing so the next scan reads
+// their tags again, keeping their IDs and the hashes which let moved files keep them too.
+func migrateNormalizedLibrary(s *Server) []string {
+	t := s.Config.PostgresTableName
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   name text NOT NULL UNIQUE
+		)`, artistsTableName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   title text NOT NULL,
+		   artist_id integer NOT NULL REFERENCES %s (id),
+		   year integer,
+		   UNIQUE (artist_id, title)
+		)`, albumsTableName, artistsTableName),
+		// The search column depends on the text columns, so it is rebuilt once they have changed type.
+		fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS search", t),
+		fmt.Sprintf(`ALTER TABLE %s
+		   ALTER COLUMN title TYPE text,
+		   ALTER COLUMN album TYPE text,
+		   ALTER COLUMN artist TYPE text,
+		   ALTER COLUMN genre TYPE text,
+		   ALTER COLUMN path TYPE text,
+		   ALTER COLUMN year TYPE integer USING CASE WHEN year ~ '^[0-9]+$' THEN year::integer END,
+		   ADD COLUMN IF NOT EXISTS artist_id integer REFERENCES %s (id) ON DELETE SET NULL,
+		   ADD COLUMN IF NOT EXISTS album_id integer REFERENCES %s (id) ON DELETE SET NULL,
+		   ADD COLUMN IF NOT EXISTS album_artist text,
+		   ADD COLUMN IF NOT EXISTS composer text,
+		   ADD COLUMN IF NOT EXISTS track integer,
+		   ADD COLUMN IF NOT EXISTS track_total integer,
+		   ADD COLUMN IF NOT EXISTS disc integer,
+		   ADD COLUMN IF NOT EXISTS disc_total integer,
+		   ADD COLUMN IF NOT EXISTS duration double precision,
+		   ADD COLUMN IF NOT EXISTS format text,
+		   ADD COLUMN IF NOT EXISTS tag_format text,
+		   ADD COLUMN IF NOT EXISTS reindex boolean NOT NULL DEFAULT false`, t, artistsTableName, albumsTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_artist_id_idx ON %s (artist_id)", t, t),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_album_id_idx ON %s (album_id)", t, t),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_year_idx ON %s (year)", t, t),
+		// Fill the new tables from what is already indexed. Tags have no album artist yet, so albums go to the track artist.
+		fmt.Sprintf("INSERT INTO %s (name) SELECT DISTINCT artist FROM %s WHERE COALESCE(artist, '') <> '' ON CONFLICT DO NOTHING",
+			artistsTableName, t),
+		fmt.Sprintf("UPDATE %s m SET artist_id = a.id FROM %s a WHERE a.name = m.artist", t, artistsTableName),
+		fmt.Sprintf(`INSERT INTO %s (title, artist_id, year) SELECT album, artist_id, MAX(year) FROM %s
+		   WHERE COALESCE(album, '') <> '' AND artist_id IS NOT NULL GROUP BY album, artist_id ON CONFLICT DO NOTHING`,
+			albumsTableName, t),
+		fmt.Sprintf("UPDATE %s m SET album_id = al.id FROM %s al WHERE al.title = m.album AND al.artist_id = m.artist_id", t, albumsTableName),
+		fmt.Sprintf("UPDATE %s SET reindex = true", t),
+	}
+	return append(statements, searchIndexStatements(t)...)
+}
+
+// The tables below were created at startup by older releases, so they are only created if missing.
+
+func migrateRequestQueue(s *Server) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   station character varying(64) NOT NULL,
+		   song_id integer NOT NULL,
+		   path character varying(510) NOT NULL,
+		   requester character varying(64) NOT NULL,
+		   requested_at timestamp with time zone NOT NULL DEFAULT now(),
+		   position integer NOT NULL,
+		   status character varying(16) NOT NULL,
+		   rid integer,
+		   updated_at timestamp with time zone NOT NULL DEFAULT now()
+		)`, queueTableName),
+		// Queues created before stations existed belong to the default station.
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS station character varying(64) NOT NULL DEFAULT '%s'",
+			queueTableName, s.defaultStation().Name),
+	}
+}
+
+func migrateAdminTables(s *Server) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   song_id integer PRIMARY KEY,
+		   reason text NOT NULL DEFAULT '',
+		   banned_at timestamp with time zone NOT NULL DEFAULT now(),
+		   banned_by character varying(128) NOT NULL
+		)`, bansTableName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   at timestamp with time zone NOT NULL DEFAULT now(),
+		   actor character varying(128) NOT NULL,
+		   action character varying(128) NOT NULL,
+		   station character varying(64) NOT NULL DEFAULT '',
+		   detail text NOT NULL DEFAULT '',
+		   status integer NOT NULL
+		)`, auditTableName),
+	}
+}
+
+func migratePlayHistory(s *Server) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   station character varying(64) NOT NULL,
+		   song_id integer,
+		   title text NOT NULL,
+		   artist text NOT NULL,
+		   started_at timestamp with time zone NOT NULL,
+		   ended_at timestamp with time zone,
+		   listeners integer NOT NULL DEFAULT 0,
+		   requested boolean NOT NULL DEFAULT false
+		)`, historyTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_station_started ON %s (station, started_at)", historyTableName, historyTableName),
+	}
+}
+
+func migrateListenerSamples(s *Server) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   station character varying(64) NOT NULL,
+		   sampled_at timestamp with time zone NOT NULL,
+		   listeners integer NOT NULL
+		)`, listenerSamplesTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_station_sampled ON %s (station, sampled_at)",
+			listenerSamplesTableName, listenerSamplesTableName),
+	}
+}
+
+// Pictures are stored once each, by content hash, and songs refer to theirs. Existing rows are
+// flagged for reindexing so the next scan finds their art.
+func migrateArt(s *Server) []string {
+	t := s.Config.PostgresTableName
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+		(
+		   id serial PRIMARY KEY,
+		   hash character(64) NOT NULL UNIQUE,
+		   mime text NOT NULL,
+		   data bytea NOT NULL,
+		   added_at timestamp with time zone NOT NULL DEFAULT now()
+		)`, artTableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS art_id integer REFERENCES %s (id) ON DELETE SET NULL", t, artTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_art_id_idx ON %s (art_id)", t, t),
+		fmt.Sprintf("UPDATE %s SET reindex = true", t),
+	}
+}
+
+// The full-text column and the full-text and trigram indexes used by search.
+func searchIndexStatements(t string) []string {
+	statements := []string{
+		fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('simple',
+		   COALESCE(artist, '') || ' ' || COALESCE(title, '') || ' ' || COALESCE(album, '') || ' ' || COALESCE(genre, ''))) STORED`, t),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_search_idx ON %s USING GIN (search)", t, t),
+	}
+	for _, column := range []string{"artist", "title", "album", "genre"} {
+		statements = append(statements, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_trgm_idx ON %s USING GIN (%s gin_trgm_ops)",
+			t, column, t, column))
+	}
+	return statements
+}
+
+// Applies every migration which has not been applied yet, each in its own transaction.
+// An advisory lock is held throughout, so that servers starting together against the same
+// database take turns and each migration is applied once.
+func (s *Server) postgresMigrate() error {
+	ctx := context.Background()
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		clog.Error("postgresMigrate", "Could not get a database connection.", err)
+		return err
+	}
+	defer conn.Close()
+	// Advisory locks belong to the session, so the lock, the migrations and the unlock share a connection.
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	if err != nil {
+		clog.Error("postgresMigrate", "Could not take the migration lock.", err)
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+	   version integer PRIMARY KEY,
+	   description text NOT NULL,
+	   applied_at timestamp with time zone NOT NULL
+	)`, migrationsTableName))
+	if err != nil {
+		clog.Error("postgresMigrate", "Failed to create the migrations table.", err)
+		return err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		clog.Error("postgresMigrate", "Failed to read applied migrations.", err)
+		return err
+	}
+	pending := 0
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		clog.Info("postgresMigrate", fmt.Sprintf("Applying migration %d: %s.", m.version, m.description))
+		if err = s.postgresApplyMigration(ctx, conn, m); err != nil {
+			clog.Error("postgresMigrate", fmt.Sprintf("Migration %d failed. The schema was left at the previous version.", m.version), err)
+			return err
+		}
+		pending++
+	}
+	clog.Info("postgresMigrate", fmt.Sprintf("Database schema is up to date at version %d (%d migrations applied).",
+		migrations[len(migrations)-1].version, pending))
+	return nil
+}
+
+// Returns the set of migration versions recorded as applied.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version FROM %s", migrationsTableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func (s *Server) postgresApplyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range m.statements(s) {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version, description, applied_at) VALUES ($1, $2, $3)", migrationsTableName),
+		m.version, m.description, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
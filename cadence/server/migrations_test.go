@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q has version %d, expected %d", m.description, m.version, i+1)
+		}
+	}
+}
+
+func TestMigrationsKeepData(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "1.mp3"), "Thunderstruck", "AC/DC")
+	connectTestPostgres(t, s)
+	songs, err := s.searchByTitleArtist(s.defaultStation(), "Thunderstruck", "AC/DC")
+	if err != nil || len(songs) != 1 {
+		t.Fatalf("indexed songs are %+v, %v", songs, err)
+	}
+	if err = s.banSong(songs[0].ID, "test", "tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Starting again must neither reapply migrations nor lose data, and a reindex keeps song IDs.
+	if err = s.postgresMigrate(); err != nil {
+		t.Fatalf("second migration: %v", err)
+	}
+	if err = s.postgresReindex(); err != nil {
+		t.Fatalf("reindex: %v", err)
+	}
+	var applied int
+	s.DB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", migrationsTableName)).Scan(&applied)
+	if applied != len(migrations) {
+		t.Errorf("%d migrations recorded, expected %d", applied, len(migrations))
+	}
+	if banned, err := s.songBanned(songs[0].ID); err != nil || !banned {
+		t.Errorf("ban was lost: %v, %v", banned, err)
+	}
+}
+
+// Upgrading a library indexed before the track columns existed reads every file's tags again,
+// without changing song IDs or losing the hashes which let moved files keep theirs.
+func TestMigrationRereadsTags(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	s.Config.MusicDir = t.TempDir()
+	path := filepath.Join(s.Config.MusicDir, "1.mp3")
+	writeTaggedMP3Frames(t, path, [2]string{"TIT2", "Thunderstruck"}, [2]string{"TPE1", "AC/DC"}, [2]string{"TRCK", "1/12"})
+	openTestPostgres(t, s)
+	id := indexBeforeMigration(t, s, 2, path)
+
+	var artistID, track sql.NullInt64
+	var format, hash sql.NullString
+	err := s.DB.QueryRow(fmt.Sprintf("SELECT artist_id, track, format, hash FROM %s WHERE id = $1", s.Config.PostgresTableName), id).
+		Scan(&artistID, &track, &format, &hash)
+	if err != nil || !artistID.Valid || track.Int64 != 1 || format.String == "" || !hash.Valid {
+		t.Errorf("upgraded song has artist %v, track %v, format %v, hash %v: %v", artistID, track, format, hash, err)
+	}
+}
+
+// Applies the migrations before version, indexes a file as a release of that schema would have,
+// then applies the rest and scans the library as a server starting up does. Returns the file's song ID.
+func indexBeforeMigration(t *testing.T, s *Server, version int, path string) (id int) {
+	t.Helper()
+	all := migrations
+	migrations = all[:version-1]
+	err := s.postgresMigrate()
+	migrations = all
+	if err != nil {
+		t.Fatalf("migrating to version %d: %v", version-1, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DB.QueryRow(fmt.Sprintf("INSERT INTO %s (title, artist, path, mtime, size, hash) VALUES ('Thunderstruck', 'AC/DC', $1, $2, $3, $4) RETURNING id",
+		s.Config.PostgresTableName), path, info.ModTime(), info.Size(), hash).Scan(&id)
+	if err != nil {
+		t.Fatalf("indexing at version %d: %v", version-1, err)
+	}
+	if err = s.postgresMigrate(); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if err = s.postgresPopulate(); err != nil {
+		t.Fatalf("scanning: %v", err)
+	}
+	var after int
+	if err = s.DB.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE path = $1", s.Config.PostgresTableName), path).Scan(&after); err != nil || after != id {
+		t.Fatalf("song <%d> is now <%d>: %v", id, after, err)
+	}
+	return id
+}
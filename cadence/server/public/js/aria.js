@@ -1,10 +1,7 @@
 var streamSrcURL = "";
 
 $(document).ready(function() {
-	getListenURL()
 	getHistory()
-	getNowPlayingMetadata()
-	getNowPlayingAlbumArt()
 	getVersion()
 	connectRadioData()
 	postSearch()
@@ -25,67 +22,6 @@ function getVersion() {
 	});
 }
 
-function getNowPlayingMetadata() {
-	$.ajax({
-		type: "GET",
-		url: "/api/nowplaying/metadata",
-		dataType: "json",
-		success: function (data) {
-			$("#song").text(data.Title);
-			$("#artist").text(data.Artist);
-		},
-		error: function () {
-			$("#song").text("-");
-			$("#artist").text("-");
-		},
-	});
-}
-
-function getNowPlayingAlbumArt() {
-	$.ajax({
-		type: "GET",
-		url: "/api/nowplaying/albumart",
-		dataType: "json",
-		success: function (data) {
-			if (data == undefined) {
-				$("#artwork").attr("src", "./static/blank.jpg");
-			} else {
-				$("#artwork").attr("src", "data:image/jpeg;base64," + data.Picture);
-			}
-		},
-		error: function () {
-			$("#artwork").attr("src", "./static/blank.jpg");
-		},
-	});
-}
-
-function getListenURL() {
-	$.ajax({
-		type: "GET",
-		url: "/api/listenurl",
-		dataType: "json",
-		success: function (data) {
-			if (data.ListenURL == "-/-") {
-				$("#status").html("Disconnected from server.");
-			} else {
-				streamSrcURL = location.protocol + "//" + data.ListenURL;
-				document.getElementById("stream").src = streamSrcURL;
-				$("#status").html(
-					"Connected: <a href='" +
-						streamSrcURL +
-						"'>" +
-						streamSrcURL +
-						"</a>"
-				);
-			}
-		},
-		error: function () {
-			document.getElementById("stream").src = "";
-			$("#status").html("Disconnected from server.");
-		},
-	});
-}
-
 function getHistory() {
 	$.ajax({
 		type: 'GET',
@@ -93,11 +29,13 @@ function getHistory() {
 		dataType: "json",
 		success: function(data) {
 			var table = "<table class='table is-striped' id='historyResults'>";
-			if (data.length === 0) {
+			// Plays are newest first. The first one may still be on air.
+			var played = data.Plays.filter(function(song) { return song.Ended !== null; });
+			if (played.length === 0) {
 				document.getElementById("historyStatus").innerHTML = "No history available (yet).";
 			} else {
 				table += "<thead><tr><th>Ended</th><th>Artist</th><th>Title</th></tr></thead><tbody>"
-				data.reverse().forEach(function(song) {
+				played.forEach(function(song) {
 					var delta = Math.round((+(new Date()) - (new Date(String(song.Ended)))) / 1000);
 
 					var minute = 60
@@ -192,7 +130,11 @@ function postRequestID() {
 				document.getElementById("requestStatus").innerHTML =
 					"Request accepted!";
 			},
-			error: function () {
+			error: function (xhr) {
+				if (xhr.status == 409 && xhr.responseJSON) {
+					$("#requestStatus").text(xhr.responseJSON.Message);
+					return;
+				}
 				document.getElementById("requestStatus").innerHTML =
 					"Sorry, your request was not accepted. You may be rate limited.";
 			},
@@ -200,45 +142,66 @@ function postRequestID() {
 	});
 }
 
+// The event stream sends the current state as soon as it connects, then every change.
 function connectRadioData() {
-	let eventSource = new EventSource("/api/radiodata/sse");
+	let eventSource = new EventSource("/api/radiodata/sse?events=nowplaying,history");
+	let songID = null;
 	eventSource.onerror = function (event) {
 		eventSource.close();
 		setTimeout(function () {
 			connectRadioData();
 		}, 10000);
 	}
-	eventSource.addEventListener("title", function(event) {
-		$('#song').text(event.data)
-	})
-	eventSource.addEventListener("artist", function(event) {
-		$('#artist').text(event.data)
-	})
-	eventSource.addEventListener("listeners", function(event) {
-		if (event.data == -1) {
+	eventSource.addEventListener("nowplaying", function(event) {
+		let now = JSON.parse(event.data);
+		$("#song").text(now.Song.Title);
+		$("#artist").text(now.Song.Artist);
+		if (now.Listeners == -1) {
 			$("#listeners").html("N/A");
 		} else {
-			$("#listeners").html(event.data);
+			$("#listeners").html(now.Listeners);
 		}
+		let key = now.Song.ID + "/" + now.Song.Title + "/" + now.Song.Artist;
+		if (key != songID) {
+			songID = key;
+			setAlbumArt(now.ArtURL);
+		}
+		setListenURL(now.ListenURL);
 	})
-	eventSource.addEventListener("title" || "artist" || "history", function() {
-		getNowPlayingAlbumArt()
+	eventSource.addEventListener("history", function() {
 		getHistory()
 	})
-	eventSource.addEventListener("listenurl", function(event) {
-		if (event.data == "-/-") {
-			document.getElementById("stream").src = "";
-			$("#status").html("Disconnected from server.");
-		} else {
-			streamSrcURL = location.protocol + "//" + event.data;
-			document.getElementById("stream").src = streamSrcURL;
-			$("#status").html(
-				"Connected: <a href='" +
-					streamSrcURL +
-					"'>" +
-					streamSrcURL +
-					"</a>"
-			);
-		}
-	});
+}
+
+function setAlbumArt(artURL) {
+	if (artURL == "") {
+		$("#artwork").attr("src", "./static/blank.jpg");
+		return;
+	}
+	// Songs without art get a 404, which falls back to the blank image.
+	$("#artwork").one("error", function () {
+		$(this).attr("src", "./static/blank.jpg");
+	}).attr("src", artURL + "?size=600");
+}
+
+function setListenURL(listenURL) {
+	if (listenURL == "") {
+		streamSrcURL = "";
+		document.getElementById("stream").src = "";
+		$("#status").html("Disconnected from server.");
+		return;
+	}
+	let url = location.protocol + "//" + listenURL;
+	if (url == streamSrcURL) {
+		return;
+	}
+	streamSrcURL = url;
+	document.getElementById("stream").src = streamSrcURL;
+	$("#status").html(
+		"Connected: <a href='" +
+			streamSrcURL +
+			"'>" +
+			streamSrcURL +
+			"</a>"
+	);
 }
@@ -0,0 +1,332 @@
+// queue.go
+// Song request queue owned by Cadence and kept in sync with Liquidsoap.
+//
+// Requests are stored in Postgres and handed to Liquidsoap one at a time, so that
+// anything not yet sent to Liquidsoap can still be cancelled or reordered.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+const queueTableName = "request_queue"
+
+// Lifecycle of a queued request.
+const (
+	queueStatusQueued    = "queued"    // Waiting in Cadence's queue.
+	queueStatusPushed    = "pushed"    // Handed to Liquidsoap, waiting in its request queue.
+	queueStatusPlaying   = "playing"   // Currently on air.
+	queueStatusPlayed    = "played"    // Finished playing.
+	queueStatusCancelled = "cancelled" // Removed by an administrator before it was played.
+)
+
+var errQueueEntryNotFound = errors.New("request queue entry not found")
+var errQueueEntryNotQueued = errors.New("request queue entry was already sent to the audio source server")
+
+type QueueEntry struct {
+	ID          int
+	Song        SongData
+	Requester   string `json:"-"`
+	RequestedAt time.Time
+	Position    int
+	Status      string
+	RID         int `json:"-"`
+}
+
+// Takes a station, a song ID and the address of the client requesting it.
+// Appends the song to the end of the station's request queue and returns the new entry.
+func (s *Server) requestQueueAdd(st *Station, songID int, requester string) (entry QueueEntry, err error) {
+	path, err := s.getPathById(st, songID)
+	if err != nil {
+		return entry, err
+	}
+	banned, err := s.songBanned(songID)
+	if err != nil {
+		clog.Error("requestQueueAdd", "Failed to check whether the song is banned.", err)
+		return entry, err
+	}
+	if banned {
+		return entry, errSongBanned
+	}
+	st.queueMutex.Lock()
+	id, err := s.requestQueueInsert(st, songID, path, requester)
+	st.queueMutex.Unlock()
+	if err != nil {
+		return entry, err
+	}
+	clog.Info("requestQueueAdd", fmt.Sprintf("Client <%s> queued song <%d> on <%s> as request <%d>.", requester, songID, st.Name, id))
+	st.SSE.SendEventMessage("update", "queue")
+	// Hand the request to Liquidsoap right away if nothing else is waiting.
+	go s.requestQueueSync(st)
+	return s.requestQueueGet(st, id)
+}
+
+// Checks the request rules and appends a request to a station's queue in one transaction. Servers sharing
+// the database take an advisory lock on the station's queue first, so requests made at the same moment
+// are checked one after another and cannot both pass. Returns the ID of the new entry.
+func (s *Server) requestQueueInsert(st *Station, songID int, path string, requester string) (id int, err error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		clog.Error("requestQueueInsert", "Failed to begin transaction.", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", queueTableName+":"+st.Name)
+	if err != nil {
+		clog.Error("requestQueueInsert", "Failed to lock the request queue.", err)
+		return 0, err
+	}
+	if err = s.checkRequestRules(tx, st, songID); err != nil {
+		if _, rejected := err.(RequestRejection); !rejected {
+			clog.Error("requestQueueInsert", "Failed to check the request rules.", err)
+		}
+		return 0, err
+	}
+	insert := fmt.Sprintf(`INSERT INTO %s (station, song_id, path, requester, position, status)
+	SELECT $1, $2, $3, $4, COALESCE(MAX(position), 0) + 1, $5 FROM %s WHERE station = $1 AND status = $5
+	RETURNING id`, queueTableName, queueTableName)
+	err = tx.QueryRow(insert, st.Name, songID, path, requester, queueStatusQueued).Scan(&id)
+	if err != nil {
+		clog.Error("requestQueueInsert", "Failed to add song to the request queue.", err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		clog.Error("requestQueueInsert", "Failed to commit the request.", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// Returns a single entry of a station's request queue by its ID.
+func (s *Server) requestQueueGet(st *Station, id int) (entry QueueEntry, err error) {
+	entries, err := s.requestQueueSelect(st, "AND q.id = $2", id)
+	if err != nil {
+		return entry, err
+	}
+	if len(entries) < 1 {
+		return entry, errQueueEntryNotFound
+	}
+	return entries[0], nil
+}
+
+// Returns the requests of a station which have not finished playing, in the order they will play.
+func (s *Server) requestQueueList(st *Station) (entries []QueueEntry, err error) {
+	return s.requestQueueSelect(st, `AND q.status IN ($2, $3, $4)
+	ORDER BY CASE q.status WHEN $2 THEN 0 WHEN $3 THEN 1 ELSE 2 END, q.position, q.id`,
+		queueStatusPlaying, queueStatusPushed, queueStatusQueued)
+}
+
+// Returns entries of a station's request queue. The condition is appended to a WHERE clause
+// which already uses $1 for the station name.
+func (s *Server) requestQueueSelect(st *Station, condition string, args ...interface{}) (entries []QueueEntry, err error) {
+	selectStatement := fmt.Sprintf(`SELECT q.id, q.song_id, %s, q.path, q.requester, q.requested_at, q.position, q.status, COALESCE(q.rid, -1)
+	FROM %s q LEFT JOIN %s m ON m.id = q.song_id WHERE q.station = $1 `, songColumns, queueTableName, s.Config.PostgresTableName) + condition
+	rows, err := s.DB.Query(selectStatement, append([]interface{}{st.Name}, args...)...)
+	if err != nil {
+		clog.Error("requestQueueSelect", "Failed to read the request queue.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	entries = []QueueEntry{}
+	for rows.Next() {
+		var e QueueEntry
+		targets := append([]interface{}{&e.ID, &e.Song.ID}, songScanTargets(&e.Song)...)
+		err = rows.Scan(append(targets, &e.Song.Path, &e.Requester, &e.RequestedAt, &e.Position, &e.Status, &e.RID)...)
+		if err != nil {
+			clog.Error("requestQueueSelect", "Data scan failed.", err)
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Takes the ID of a request which has not yet been sent to Liquidsoap and cancels it.
+func (s *Server) requestQueueCancel(st *Station, id int) error {
+	st.queueMutex.Lock()
+	defer st.queueMutex.Unlock()
+	entry, err := s.requestQueueGet(st, id)
+	if err != nil {
+		return err
+	}
+	if entry.Status != queueStatusQueued {
+		return errQueueEntryNotQueued
+	}
+	_, err = s.DB.Exec(fmt.Sprintf("UPDATE %s SET status = $1, updated_at = now() WHERE id = $2", queueTableName),
+		queueStatusCancelled, id)
+	if err != nil {
+		clog.Error("requestQueueCancel", "Failed to cancel request.", err)
+		return err
+	}
+	clog.Info("requestQueueCancel", fmt.Sprintf("Request <%d> was cancelled.", id))
+	st.SSE.SendEventMessage("update", "queue")
+	return nil
+}
+
+// Takes the ID of a request which has not yet been sent to Liquidsoap and
+// moves it to a new 1-based position among the waiting requests.
+func (s *Server) requestQueueMove(st *Station, id int, position int) error {
+	st.queueMutex.Lock()
+	defer st.queueMutex.Unlock()
+	rows, err := s.DB.Query(fmt.Sprintf("SELECT id FROM %s WHERE station = $1 AND status = $2 ORDER BY position, id", queueTableName),
+		st.Name, queueStatusQueued)
+	if err != nil {
+		clog.Error("requestQueueMove", "Failed to read the request queue.", err)
+		return err
+	}
+	var order []int
+	found := false
+	for rows.Next() {
+		var qid int
+		if err = rows.Scan(&qid); err != nil {
+			rows.Close()
+			clog.Error("requestQueueMove", "Data scan failed.", err)
+			return err
+		}
+		if qid == id {
+			found = true
+			continue
+		}
+		order = append(order, qid)
+	}
+	rows.Close()
+	if !found {
+		if _, err := s.requestQueueGet(st, id); err == nil {
+			return errQueueEntryNotQueued
+		}
+		return errQueueEntryNotFound
+	}
+	if position < 1 {
+		position = 1
+	}
+	if position > len(order)+1 {
+		position = len(order) + 1
+	}
+	order = append(order[:position-1], append([]int{id}, order[position-1:]...)...)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		clog.Error("requestQueueMove", "Failed to begin transaction.", err)
+		return err
+	}
+	for i, qid := range order {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET position = $1, updated_at = now() WHERE id = $2", queueTableName), i+1, qid)
+		if err != nil {
+			clog.Error("requestQueueMove", "Failed to reorder the request queue.", err)
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		clog.Error("requestQueueMove", "Failed to commit the new request queue order.", err)
+		return err
+	}
+	clog.Info("requestQueueMove", fmt.Sprintf("Request <%d> was moved to position <%d>.", id, position))
+	st.SSE.SendEventMessage("update", "queue")
+	return nil
+}
+
+// Cancels every request of a station which has not yet been sent to Liquidsoap. Returns how many were cancelled.
+func (s *Server) requestQueueClear(st *Station) (int, error) {
+	st.queueMutex.Lock()
+	defer st.queueMutex.Unlock()
+	result, err := s.DB.Exec(fmt.Sprintf("UPDATE %s SET status = $1, updated_at = now() WHERE station = $2 AND status = $3", queueTableName),
+		queueStatusCancelled, st.Name, queueStatusQueued)
+	if err != nil {
+		clog.Error("requestQueueClear", "Failed to clear the request queue.", err)
+		return 0, err
+	}
+	cleared, _ := result.RowsAffected()
+	clog.Info("requestQueueClear", fmt.Sprintf("Cleared <%d> requests from <%s>.", cleared, st.Name))
+	if cleared > 0 {
+		st.SSE.SendEventMessage("update", "queue")
+	}
+	return int(cleared), nil
+}
+
+// Brings a station's request queue in line with its Liquidsoap.
+// Requests handed to Liquidsoap are marked playing or played according to their Liquidsoap status,
+// and the next waiting request is pushed once Liquidsoap has nothing of ours left to play.
+// Only the sync loop changes requests once they are pushed, so Liquidsoap is read without holding
+// the queue lock, and a slow Liquidsoap holds up requests only while the next one is pushed.
+func (s *Server) requestQueueSync(st *Station) {
+	st.syncMutex.Lock()
+	defer st.syncMutex.Unlock()
+	rids, err := st.Liquidsoap.Queue(st.RequestQueue)
+	if err != nil {
+		clog.Debug("requestQueueSync", "Unable to read the audio source server request queue.")
+		return
+	}
+	waiting := make(map[int]bool)
+	for _, rid := range rids {
+		waiting[rid] = true
+	}
+	active, err := s.requestQueueSelect(st, "AND q.status IN ($2, $3) ORDER BY q.id", queueStatusPushed, queueStatusPlaying)
+	if err != nil {
+		return
+	}
+	pending := 0
+	for _, entry := range active {
+		if waiting[entry.RID] {
+			pending++
+			continue
+		}
+		status := queueStatusPlayed
+		metadata, err := st.Liquidsoap.Metadata(entry.RID)
+		if err == nil && metadata["status"] == "playing" {
+			status = queueStatusPlaying
+		}
+		if status != entry.Status {
+			_, err = s.DB.Exec(fmt.Sprintf("UPDATE %s SET status = $1, updated_at = now() WHERE id = $2", queueTableName), status, entry.ID)
+			if err != nil {
+				clog.Error("requestQueueSync", fmt.Sprintf("Failed to update status of request <%d>.", entry.ID), err)
+				continue
+			}
+			clog.Debug("requestQueueSync", fmt.Sprintf("Request <%d> is now %s.", entry.ID, status))
+			st.SSE.SendEventMessage("update", "queue")
+		}
+	}
+	if pending > 0 {
+		return
+	}
+
+	// Holding the lock while pushing keeps the request from being cancelled or moved meanwhile.
+	st.queueMutex.Lock()
+	defer st.queueMutex.Unlock()
+	var next QueueEntry
+	err = s.DB.QueryRow(fmt.Sprintf("SELECT id, path FROM %s WHERE station = $1 AND status = $2 ORDER BY position, id LIMIT 1", queueTableName),
+		st.Name, queueStatusQueued).Scan(&next.ID, &next.Song.Path)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		clog.Error("requestQueueSync", "Failed to read the next request.", err)
+		return
+	}
+	rid, err := st.Liquidsoap.Push(st.RequestQueue, next.Song.Path)
+	if err != nil {
+		clog.Error("requestQueueSync", fmt.Sprintf("Failed to submit request <%d> to the audio source server.", next.ID), err)
+		return
+	}
+	_, err = s.DB.Exec(fmt.Sprintf("UPDATE %s SET status = $1, rid = $2, updated_at = now() WHERE id = $3", queueTableName),
+		queueStatusPushed, rid, next.ID)
+	if err != nil {
+		clog.Error("requestQueueSync", fmt.Sprintf("Failed to record submission of request <%d>.", next.ID), err)
+		return
+	}
+	st.SSE.SendEventMessage("update", "queue")
+}
+
+// Periodically syncs a station's request queue with its Liquidsoap.
+func (s *Server) requestQueueMonitor(st *Station) {
+	for {
+		time.Sleep(2 * time.Second)
+		s.requestQueueSync(st)
+	}
+}
@@ -0,0 +1,378 @@
+// ratelimit.go
+// Per-client rate limits for song requests and other routes.
+//
+// Each limited route has a policy: a token bucket, which allows bursts of up to Limit requests
+// and refills at Limit per Period, or a sliding window, which allows at most Limit requests in any
+// Period. Limits are counted in Redis, so that several Cadence servers share them, or in memory.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenellorando/clog"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate limit algorithms.
+const (
+	rateLimitTokenBucket   = "tokenbucket"
+	rateLimitSlidingWindow = "slidingwindow"
+)
+
+// Routes which may be rate limited, each configured with CSERVER_RATELIMIT_<ROUTE>.
+// Song requests are also limited by CSERVER_REQRATELIMIT, which allows one request per that many seconds.
+var rateLimitRoutes = []string{"request", "search", "art"}
+
+var errInvalidRateLimitPolicy = errors.New("invalid rate limit policy")
+
+type RateLimitPolicy struct {
+	Algorithm string
+	Limit     int
+	Period    time.Duration
+}
+
+// The outcome of counting a request against a policy.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // Requests the client may still make right now.
+	Reset      time.Duration // Until the client's allowance is whole again.
+	RetryAfter time.Duration // Until the client may make another request, if it was not allowed.
+}
+
+// A RateLimiter counts the requests of clients against policies.
+type RateLimiter interface {
+	// Counts a request of a client, identified by key, and reports whether the policy allows it.
+	Allow(ctx context.Context, key string, policy RateLimitPolicy) (RateLimitResult, error)
+	Close() error
+}
+
+// Parses a policy such as "tokenbucket:5/1m" or "slidingwindow:1/30s".
+func parseRateLimitPolicy(value string) (policy RateLimitPolicy, err error) {
+	algorithm, rate, found := strings.Cut(value, ":")
+	limit, period, foundPeriod := strings.Cut(rate, "/")
+	if !found || !foundPeriod || (algorithm != rateLimitTokenBucket && algorithm != rateLimitSlidingWindow) {
+		return policy, fmt.Errorf("%w <%s>", errInvalidRateLimitPolicy, value)
+	}
+	policy.Algorithm = algorithm
+	if policy.Limit, err = strconv.Atoi(limit); err != nil || policy.Limit < 1 {
+		return policy, fmt.Errorf("%w <%s>: limit must be a positive number", errInvalidRateLimitPolicy, value)
+	}
+	if policy.Period, err = time.ParseDuration(period); err != nil || policy.Period <= 0 {
+		return policy, fmt.Errorf("%w <%s>: period must be a positive duration", errInvalidRateLimitPolicy, value)
+	}
+	return policy, nil
+}
+
+// Reads rate limit policies from the environment. Routes without one are not limited.
+func rateLimitPoliciesFromEnv(c ServerConfig) (policies map[string]RateLimitPolicy, err error) {
+	policies = make(map[string]RateLimitPolicy)
+	if c.RequestRateLimit > 0 {
+		policies["request"] = RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 1, Period: time.Duration(c.RequestRateLimit) * time.Second}
+	}
+	for _, route := range rateLimitRoutes {
+		value := os.Getenv("CSERVER_RATELIMIT_" + strings.ToUpper(route))
+		if value == "" {
+			continue
+		}
+		if policies[route], err = parseRateLimitPolicy(value); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+// Creates the rate limiter named by CSERVER_RATELIMIT_BACKEND: redis or memory.
+// Without it, Redis is used if an address is configured.
+func newRateLimiter(c ServerConfig) RateLimiter {
+	address := c.RedisAddress + c.RedisPort
+	switch c.RateLimitBackend {
+	case "redis":
+		return NewRedisRateLimiter(address)
+	case "memory":
+		return NewMemoryRateLimiter()
+	case "":
+		if address != "" {
+			return NewRedisRateLimiter(address)
+		}
+		return NewMemoryRateLimiter()
+	}
+	clog.Warn("newRateLimiter", fmt.Sprintf("Unknown rate limit backend <%s>. Rate limits are counted in memory.", c.RateLimitBackend))
+	return NewMemoryRateLimiter()
+}
+
+// Returns the policy of a route, and whether it has one.
+func (s *Server) rateLimitPolicy(route string) (RateLimitPolicy, bool) {
+	s.rateLimitMutex.RLock()
+	defer s.rateLimitMutex.RUnlock()
+	policy, ok := s.rateLimitPolicies[route]
+	return policy, ok
+}
+
+// Replaces the policy of a route. A zero policy removes the route's limit.
+func (s *Server) setRateLimitPolicy(route string, policy RateLimitPolicy) {
+	s.rateLimitMutex.Lock()
+	defer s.rateLimitMutex.Unlock()
+	if policy.Limit < 1 || policy.Period <= 0 {
+		delete(s.rateLimitPolicies, route)
+		return
+	}
+	s.rateLimitPolicies[route] = policy
+}
+
+// Wraps a handler with the rate limit policy of a route, counted per client address.
+// Every limited response tells the client its allowance in RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers. Rejected requests also get Retry-After.
+func (s *Server) rateLimit(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := s.rateLimitPolicy(route)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip, err := checkIP(r)
+		if err != nil {
+			clog.Error("rateLimit", "Error encountered while checking IP address.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		result, err := s.rateLimiter.Allow(r.Context(), route+":"+ip, policy)
+		if err != nil {
+			clog.Error("rateLimit", "Error while attempting to check for IP in rate limiter.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, ceilSeconds(policy.Period)))
+		if !result.Allowed {
+			clog.Debug("rateLimit", fmt.Sprintf("Client <%s> is rate limited on <%s>.", ip, route))
+			s.metrics.rateLimitRejections.WithLabelValues(route).Inc()
+			retryAfter := ceilSeconds(result.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests) // 429 Too Many Requests
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimiter counts requests in this process.
+type MemoryRateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*memoryRateLimitState
+	lastSweep time.Time
+}
+
+type memoryRateLimitState struct {
+	tokens  float64     // Token bucket: tokens left at updated.
+	updated time.Time   // Token bucket: when tokens was counted.
+	hits    []time.Time // Sliding window: allowed requests within the last period, oldest first.
+	expires time.Time   // When the state is back to that of a new client and may be forgotten.
+}
+
+// How often idle clients are forgotten.
+const memoryRateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{now: time.Now, clients: make(map[string]*memoryRateLimitState)}
+}
+
+func (m *MemoryRateLimiter) Allow(ctx context.Context, key string, policy RateLimitPolicy) (result RateLimitResult, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.lastSweep) >= memoryRateLimitSweepInterval {
+		for k, state := range m.clients {
+			if now.After(state.expires) {
+				delete(m.clients, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	state, ok := m.clients[key]
+	if !ok {
+		state = &memoryRateLimitState{tokens: float64(policy.Limit), updated: now}
+		m.clients[key] = state
+	}
+
+	switch policy.Algorithm {
+	case rateLimitTokenBucket:
+		perToken := policy.Period / time.Duration(policy.Limit)
+		state.tokens = math.Min(float64(policy.Limit), state.tokens+float64(now.Sub(state.updated))/float64(perToken))
+		state.updated = now
+		if state.tokens >= 1 {
+			state.tokens--
+			result.Allowed = true
+		} else {
+			result.RetryAfter = time.Duration((1 - state.tokens) * float64(perToken))
+		}
+		result.Remaining = int(state.tokens)
+		result.Reset = time.Duration((float64(policy.Limit) - state.tokens) * float64(perToken))
+	default:
+		for len(state.hits) > 0 && !state.hits[0].After(now.Add(-policy.Period)) {
+			state.hits = state.hits[1:]
+		}
+		if len(state.hits) < policy.Limit {
+			state.hits = append(state.hits, now)
+			result.Allowed = true
+		}
+		result.Remaining = policy.Limit - len(state.hits)
+		result.Reset = state.hits[0].Add(policy.Period).Sub(now)
+		if !result.Allowed {
+			result.RetryAfter = result.Reset
+		}
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0 // The limit was lowered since the client's last requests.
+	}
+	state.expires = now.Add(result.Reset)
+	return result, nil
+}
+
+func (m *MemoryRateLimiter) Close() error {
+	return nil
+}
+
+// RedisRateLimiter counts requests in Redis. Each check is one script, so it is atomic
+// across every Cadence server sharing the Redis.
+type RedisRateLimiter struct {
+	client *redis.Client
+	// Makes sliding window entries unique when requests arrive in the same millisecond.
+	sequence atomic.Uint64
+}
+
+func NewRedisRateLimiter(address string) *RedisRateLimiter {
+	return &RedisRateLimiter{client: redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: "",
+		DB:       0,
+	})}
+}
+
+// Takes the capacity, the milliseconds it takes to refill one token, and the time in milliseconds.
+// Returns whether the request is allowed and the tokens left.
+var redisTokenBucket = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local per_token = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) / per_token)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) * per_token) + 1)
+return {allowed, tostring(tokens)}
+`)
+
+// Takes the limit, the period and the time in milliseconds, and a unique member for this request.
+// Returns whether the request is allowed, the requests in the window and the time of the oldest.
+var redisSlidingWindow = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - period)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], period)
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {allowed, count, oldest[2] or tostring(now)}
+`)
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, policy RateLimitPolicy) (result RateLimitResult, err error) {
+	now := time.Now().UnixMilli()
+	key = "ratelimit:" + policy.Algorithm + ":" + key
+	switch policy.Algorithm {
+	case rateLimitTokenBucket:
+		perToken := float64(policy.Period.Milliseconds()) / float64(policy.Limit)
+		reply, err := redisTokenBucket.Run(ctx, l.client, []string{key}, policy.Limit, perToken, now).Slice()
+		if err != nil || len(reply) != 2 {
+			return result, fmt.Errorf("token bucket script: %v", err)
+		}
+		allowed, _ := reply[0].(int64)
+		tokensText, _ := reply[1].(string)
+		tokens, _ := strconv.ParseFloat(tokensText, 64)
+		result.Allowed = allowed == 1
+		result.Remaining = int(tokens)
+		result.Reset = time.Duration((float64(policy.Limit) - tokens) * perToken * float64(time.Millisecond))
+		if !result.Allowed {
+			result.RetryAfter = time.Duration((1 - tokens) * perToken * float64(time.Millisecond))
+		}
+	default:
+		member := fmt.Sprintf("%d-%d", now, l.sequence.Add(1))
+		reply, err := redisSlidingWindow.Run(ctx, l.client, []string{key}, policy.Limit, policy.Period.Milliseconds(), now, member).Slice()
+		if err != nil || len(reply) != 3 {
+			return result, fmt.Errorf("sliding window script: %v", err)
+		}
+		allowed, _ := reply[0].(int64)
+		count, _ := reply[1].(int64)
+		oldestText, _ := reply[2].(string)
+		oldest, _ := strconv.ParseFloat(oldestText, 64)
+		result.Allowed = allowed == 1
+		if result.Remaining = policy.Limit - int(count); result.Remaining < 0 {
+			result.Remaining = 0
+		}
+		result.Reset = time.Duration(int64(oldest)+policy.Period.Milliseconds()-now) * time.Millisecond
+		if !result.Allowed {
+			result.RetryAfter = result.Reset
+		}
+	}
+	return result, nil
+}
+
+func (l *RedisRateLimiter) Ping(ctx context.Context) error {
+	return l.client.Ping(ctx).Err()
+}
+
+func (l *RedisRateLimiter) Close() error {
+	return l.client.Close()
+}
+
+func checkIP(r *http.Request) (ip string, err error) {
+	// We look at the remote address and check the IP.
+	// If for some reason no remote IP is there, we error to reject.
+	if r.RemoteAddr != "" {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clog.Error("checkIP", "Error while splitting client address IP and port. The request will be rejected.", err)
+			return "", err
+		}
+		if ip == "" {
+			clog.Warn("checkIP", "IP address of a client was blank, and could not be checked. The request will be rejected.")
+			return "", err
+		}
+		return ip, nil
+	}
+	return "", err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitPolicy(t *testing.T) {
+	for value, want := range map[string]RateLimitPolicy{
+		"tokenbucket:5/1m":    {Algorithm: rateLimitTokenBucket, Limit: 5, Period: time.Minute},
+		"slidingwindow:1/30s": {Algorithm: rateLimitSlidingWindow, Limit: 1, Period: 30 * time.Second},
+	} {
+		if got, err := parseRateLimitPolicy(value); err != nil || got != want {
+			t.Errorf("policy %q is %+v, %v", value, got, err)
+		}
+	}
+	for _, value := range []string{"", "tokenbucket", "leakybucket:1/1s", "tokenbucket:0/1s", "slidingwindow:1/soon", "slidingwindow:1/-1s"} {
+		if _, err := parseRateLimitPolicy(value); err == nil {
+			t.Errorf("policy %q was accepted", value)
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	allow := func(key string, policy RateLimitPolicy) RateLimitResult {
+		t.Helper()
+		result, err := limiter.Allow(context.Background(), key, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// A bucket of three tokens allows a burst of three, then one request every 20 seconds.
+	bucket := RateLimitPolicy{Algorithm: rateLimitTokenBucket, Limit: 3, Period: time.Minute}
+	for i := 2; i >= 0; i-- {
+		if result := allow("bucket", bucket); !result.Allowed || result.Remaining != i {
+			t.Fatalf("burst request was %+v", result)
+		}
+	}
+	if result := allow("bucket", bucket); result.Allowed || result.RetryAfter != 20*time.Second || result.Reset != time.Minute {
+		t.Errorf("request beyond the burst was %+v", result)
+	}
+	now = now.Add(20 * time.Second)
+	if result := allow("bucket", bucket); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("request after a refill was %+v", result)
+	}
+
+	// A window of two requests a minute counts the requests of the last minute.
+	window := RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 2, Period: time.Minute}
+	allow("window", window)
+	now = now.Add(40 * time.Second)
+	allow("window", window)
+	if result := allow("window", window); result.Allowed || result.RetryAfter != 20*time.Second {
+		t.Errorf("request beyond the window was %+v", result)
+	}
+	now = now.Add(20 * time.Second)
+	if result := allow("window", window); !result.Allowed || result.Remaining != 0 || result.Reset != 40*time.Second {
+		t.Errorf("request after the oldest left the window was %+v", result)
+	}
+	if result := allow("other", window); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("another client's request was %+v", result)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	s.setRateLimitPolicy("search", RateLimitPolicy{Algorithm: rateLimitSlidingWindow, Limit: 1, Period: 30 * time.Second})
+	routes := s.routes()
+	search := func(remoteAddr string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/search", strings.NewReader(`{"search": "year:abc"}`))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := search("192.0.2.1:1234")
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Remaining") != "0" ||
+		rec.Header().Get("RateLimit-Reset") != "30" || rec.Header().Get("RateLimit-Policy") != "1;w=30" {
+		t.Errorf("first search returned %d %v", rec.Code, rec.Header())
+	}
+	rec = search("192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("second search returned %d %v", rec.Code, rec.Header())
+	}
+	if rec = search("192.0.2.2:1234"); rec.Code != http.StatusBadRequest {
+		t.Errorf("another client's search returned %d", rec.Code)
+	}
+	// Routes without a policy are not limited.
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if rec.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route has headers %v", rec.Header())
+	}
+}
@@ -0,0 +1,149 @@
+// requestrules.go
+// Rules a song request must pass before it joins the request queue.
+//
+// Unlike rate limits, which count each client separately, these rules apply to every listener alike,
+// so that the same song or artist cannot be requested over and over by different clients.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Reasons a request can be rejected by the request rules.
+const (
+	rejectNowPlaying     = "now_playing"     // The song is on air.
+	rejectSongCooldown   = "song_cooldown"   // The song played or was requested too recently.
+	rejectArtistCooldown = "artist_cooldown" // The artist played or was requested too recently.
+	rejectArtistQueued   = "artist_queued"   // The artist already has as many requests waiting as allowed.
+)
+
+// Rules checked against every song request. A zero cooldown or limit turns that rule off.
+type RequestRules struct {
+	SongCooldown     time.Duration // How long after a song played or was requested before it can be requested again.
+	ArtistCooldown   time.Duration // The same for any song by the song's artist.
+	ArtistQueueLimit int           // How many requests by one artist can wait in the queue at once.
+	AllowNowPlaying  bool          // Whether the song on air can be requested.
+}
+
+// A request turned away by the request rules. It is written to the client as the body of a 409 Conflict.
+type RequestRejection struct {
+	Reason     string
+	Message    string
+	RetryAfter int `json:",omitempty"` // Seconds until the request would pass, if the rule is a cooldown.
+}
+
+func (r RequestRejection) Error() string {
+	return r.Message
+}
+
+// Reads the request rules from CSERVER_REQUEST_SONGCOOLDOWN and CSERVER_REQUEST_ARTISTCOOLDOWN,
+// which are durations such as "2h", CSERVER_REQUEST_ARTISTQUEUELIMIT and CSERVER_REQUEST_ALLOWNOWPLAYING.
+func requestRulesFromEnv() (rules RequestRules, err error) {
+	for name, target := range map[string]*time.Duration{
+		"CSERVER_REQUEST_SONGCOOLDOWN":   &rules.SongCooldown,
+		"CSERVER_REQUEST_ARTISTCOOLDOWN": &rules.ArtistCooldown,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if *target, err = time.ParseDuration(value); err != nil || *target < 0 {
+				return rules, fmt.Errorf("invalid %s <%s>", name, value)
+			}
+		}
+	}
+	if value := os.Getenv("CSERVER_REQUEST_ARTISTQUEUELIMIT"); value != "" {
+		if rules.ArtistQueueLimit, err = strconv.Atoi(value); err != nil || rules.ArtistQueueLimit < 0 {
+			return rules, fmt.Errorf("invalid CSERVER_REQUEST_ARTISTQUEUELIMIT <%s>", value)
+		}
+	}
+	if value := os.Getenv("CSERVER_REQUEST_ALLOWNOWPLAYING"); value != "" {
+		if rules.AllowNowPlaying, err = strconv.ParseBool(value); err != nil {
+			return rules, fmt.Errorf("invalid CSERVER_REQUEST_ALLOWNOWPLAYING <%s>", value)
+		}
+	}
+	return rules, nil
+}
+
+// Takes a station and the ID of a song in its library. Returns a RequestRejection if a request
+// for the song breaks one of the request rules. Queries run in tx, which must hold the station's
+// queue lock until the request is inserted (see requestQueueInsert). Songs without an artist are
+// not subject to the artist rules.
+func (s *Server) checkRequestRules(tx *sql.Tx, st *Station, songID int) error {
+	rules := s.Config.RequestRules
+	if !rules.AllowNowPlaying && st.nowPlaying().Song.ID == songID {
+		return RequestRejection{Reason: rejectNowPlaying, Message: "The song is playing now."}
+	}
+	if rules.SongCooldown == 0 && rules.ArtistCooldown == 0 && rules.ArtistQueueLimit == 0 {
+		return nil
+	}
+
+	var artist string
+	err := tx.QueryRow(fmt.Sprintf("SELECT COALESCE(artist, '') FROM %s WHERE id = $1", s.Config.PostgresTableName), songID).Scan(&artist)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if rules.SongCooldown > 0 {
+		last, err := lastPlayedOrRequested(tx, st, "song_id = $2", songID)
+		if err != nil {
+			return err
+		}
+		if wait := cooldownRemaining(last, rules.SongCooldown); wait > 0 {
+			return RequestRejection{Reason: rejectSongCooldown, RetryAfter: wait,
+				Message: fmt.Sprintf("The song was played or requested recently. It can be requested again in %s.", time.Duration(wait)*time.Second)}
+		}
+	}
+	if rules.ArtistCooldown > 0 && artist != "" {
+		last, err := lastPlayedOrRequested(tx, st, fmt.Sprintf("song_id IN (SELECT id FROM %s WHERE artist = $2)", s.Config.PostgresTableName), artist)
+		if err != nil {
+			return err
+		}
+		if wait := cooldownRemaining(last, rules.ArtistCooldown); wait > 0 {
+			return RequestRejection{Reason: rejectArtistCooldown, RetryAfter: wait,
+				Message: fmt.Sprintf("%s was played or requested recently. Their songs can be requested again in %s.", artist, time.Duration(wait)*time.Second)}
+		}
+	}
+	if rules.ArtistQueueLimit > 0 && artist != "" {
+		var queued int
+		err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s q JOIN %s m ON m.id = q.song_id
+		WHERE q.station = $1 AND m.artist = $2 AND q.status IN ($3, $4)`, queueTableName, s.Config.PostgresTableName),
+			st.Name, artist, queueStatusQueued, queueStatusPushed).Scan(&queued)
+		if err != nil {
+			return err
+		}
+		if queued >= rules.ArtistQueueLimit {
+			return RequestRejection{Reason: rejectArtistQueued,
+				Message: fmt.Sprintf("%s already has %d requests waiting in the queue.", artist, queued)}
+		}
+	}
+	return nil
+}
+
+// Returns when songs matching the condition last started playing on a station or were requested
+// there, whichever is later, or a null time if they never have. The condition uses $2 for its argument.
+func lastPlayedOrRequested(tx *sql.Tx, st *Station, condition string, arg interface{}) (last sql.NullTime, err error) {
+	err = tx.QueryRow(fmt.Sprintf(`SELECT GREATEST(
+	   (SELECT MAX(started_at) FROM %s WHERE station = $1 AND %s),
+	   (SELECT MAX(requested_at) FROM %s WHERE station = $1 AND status <> $3 AND %s))`,
+		historyTableName, condition, queueTableName, condition), st.Name, arg, queueStatusCancelled).Scan(&last)
+	return last, err
+}
+
+// Returns the whole seconds left of a cooldown which started at last, or 0 if it is over.
+func cooldownRemaining(last sql.NullTime, cooldown time.Duration) int {
+	if !last.Valid {
+		return 0
+	}
+	remaining := time.Until(last.Time.Add(cooldown))
+	if remaining <= 0 {
+		return 0
+	}
+	return int(math.Ceil(remaining.Seconds()))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestRulesFromEnv(t *testing.T) {
+	t.Setenv("CSERVER_REQUEST_SONGCOOLDOWN", "2h")
+	t.Setenv("CSERVER_REQUEST_ARTISTCOOLDOWN", "30m")
+	t.Setenv("CSERVER_REQUEST_ARTISTQUEUELIMIT", "2")
+	rules, err := requestRulesFromEnv()
+	want := RequestRules{SongCooldown: 2 * time.Hour, ArtistCooldown: 30 * time.Minute, ArtistQueueLimit: 2}
+	if err != nil || rules != want {
+		t.Errorf("rules are %+v, %v", rules, err)
+	}
+	for name, value := range map[string]string{
+		"CSERVER_REQUEST_SONGCOOLDOWN":     "soon",
+		"CSERVER_REQUEST_ARTISTCOOLDOWN":   "-1m",
+		"CSERVER_REQUEST_ARTISTQUEUELIMIT": "many",
+		"CSERVER_REQUEST_ALLOWNOWPLAYING":  "perhaps",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := requestRulesFromEnv(); err == nil {
+				t.Errorf("%s=%s was accepted", name, value)
+			}
+		})
+	}
+}
+
+func TestRequestNowPlaying(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	st := s.defaultStation()
+	st.updateNowPlaying(func(now *RadioInfo) { now.Song.ID = 7 })
+
+	err := s.checkRequestRules(nil, st, 7)
+	if rejection, ok := err.(RequestRejection); !ok || rejection.Reason != rejectNowPlaying {
+		t.Errorf("requesting the song on air returned %v", err)
+	}
+	if err = s.checkRequestRules(nil, st, 8); err != nil {
+		t.Errorf("requesting another song returned %v", err)
+	}
+	s.Config.RequestRules.AllowNowPlaying = true
+	if err = s.checkRequestRules(nil, st, 7); err != nil {
+		t.Errorf("requesting the song on air while allowed returned %v", err)
+	}
+}
+
+func TestCooldownRemaining(t *testing.T) {
+	if wait := cooldownRemaining(sql.NullTime{}, time.Hour); wait != 0 {
+		t.Errorf("never played has %d seconds left", wait)
+	}
+	if wait := cooldownRemaining(sql.NullTime{Time: time.Now().Add(-30 * time.Minute), Valid: true}, time.Hour); wait < 1799 || wait > 1800 {
+		t.Errorf("half over has %d seconds left", wait)
+	}
+	if wait := cooldownRemaining(sql.NullTime{Time: time.Now().Add(-2 * time.Hour), Valid: true}, time.Hour); wait != 0 {
+		t.Errorf("over has %d seconds left", wait)
+	}
+}
+
+// Requests songs against a disposable Postgres until each rule turns one away.
+func TestRequestRules(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "first.mp3"), "First", "Artist")
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "second.mp3"), "Second", "Artist")
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "untagged1.mp3"), "Untagged One", "")
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "untagged2.mp3"), "Untagged Two", "")
+	connectTestPostgres(t, s)
+	songID := func(title string) int {
+		t.Helper()
+		var id int
+		if err := s.DB.QueryRow("SELECT id FROM "+s.Config.PostgresTableName+" WHERE title = $1", title).Scan(&id); err != nil {
+			t.Fatalf("%s was not indexed: %v", title, err)
+		}
+		return id
+	}
+	first, second := songID("First"), songID("Second")
+	request := func(songID int) (int, RequestRejection) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/request/id", strings.NewReader(fmt.Sprintf(`{"ID":"%d"}`, songID)))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		s.RequestID(st).ServeHTTP(rec, req)
+		var rejection RequestRejection
+		if rec.Code == http.StatusConflict {
+			json.Unmarshal(rec.Body.Bytes(), &rejection)
+		}
+		return rec.Code, rejection
+	}
+
+	s.Config.RequestRules = RequestRules{SongCooldown: time.Hour, ArtistQueueLimit: 1}
+	if code, _ := request(first); code != http.StatusAccepted {
+		t.Fatalf("first request returned %d", code)
+	}
+	if code, rejection := request(first); code != http.StatusConflict || rejection.Reason != rejectSongCooldown || rejection.RetryAfter < 3599 {
+		t.Errorf("repeated request returned %d %+v", code, rejection)
+	}
+	if code, rejection := request(second); code != http.StatusConflict || rejection.Reason != rejectArtistQueued {
+		t.Errorf("request beyond the artist's limit returned %d %+v", code, rejection)
+	}
+	// Songs without an artist do not share one artist's quota.
+	for _, title := range []string{"Untagged One", "Untagged Two"} {
+		if code, rejection := request(songID(title)); code != http.StatusAccepted {
+			t.Errorf("request for %s returned %d %+v", title, code, rejection)
+		}
+	}
+	s.Config.RequestRules = RequestRules{ArtistCooldown: time.Hour}
+	if code, rejection := request(second); code != http.StatusConflict || rejection.Reason != rejectArtistCooldown {
+		t.Errorf("request within the artist's cooldown returned %d %+v", code, rejection)
+	}
+}
@@ -6,28 +6,86 @@ package main
 import (
 	"net/http"
 
-	"gopkg.in/antage/eventsource.v1"
+	"github.com/kenellorando/clog"
 )
 
-var radiodata_sse = eventsource.New(nil, nil)
-
-func routes() *http.ServeMux {
+func (s *Server) routes() http.Handler {
 	r := http.NewServeMux()
-	r.Handle("/api/radiodata/sse", radiodata_sse)
-	r.Handle("/api/search", Search())
-	r.Handle("/api/request/id", rateLimitRequest(RequestID()))
-	r.Handle("/api/request/bestmatch", rateLimitRequest(RequestBestMatch()))
-	r.Handle("/api/nowplaying/metadata", NowPlayingMetadata())
-	r.Handle("/api/nowplaying/albumart", rateLimitArt(NowPlayingAlbumArt()))
-	r.Handle("/api/history", History())
-	r.Handle("/api/listenurl", ListenURL())
-	r.Handle("/api/listeners", Listeners())
-	r.Handle("/api/bitrate", Bitrate())
-	r.Handle("/api/version", Version())
-	r.Handle("/ready", Ready())
-	if c.DevMode {
-		r.Handle("/api/dev/skip", DevSkip())
+	for _, st := range s.Stations {
+		s.stationRoutes(r, "/api/"+st.Name, st)
+	}
+	// Unscoped routes keep serving the default station for existing clients.
+	s.stationRoutes(r, "/api", s.defaultStation())
+	if s.adminEnabled() {
+		s.adminRoutes(r)
+	} else {
+		clog.Warn("routes", "No admin credentials are configured. The admin API is disabled.")
+	}
+	if s.trackPushEnabled() {
+		for _, st := range s.Stations {
+			r.Handle("/api/internal/"+st.Name+"/track", s.InternalTrack(st))
+		}
+		r.Handle("/api/internal/track", s.InternalTrack(s.defaultStation()))
+	}
+	r.Handle("/api/stations", s.StationList())
+	r.Handle("/api/version", s.Version())
+	r.Handle("/api/art/", s.rateLimit("art", s.Art("/api/art/")))
+	r.Handle("/ready", s.Ready())
+	r.Handle("/live", s.Live())
+	r.Handle("/metrics", s.MetricsHandler())
+	r.Handle("/", http.FileServer(http.Dir(s.Config.RootPath+"./public/")))
+	return s.resolveClientAddress(s.instrument(r))
+}
+
+// Registers the routes of one station under a path prefix.
+func (s *Server) stationRoutes(r *http.ServeMux, prefix string, st *Station) {
+	r.Handle(prefix+"/radiodata/sse", st.SSE)
+	r.Handle(prefix+"/ws", s.WebSocket(st))
+	r.Handle(prefix+"/search", s.rateLimit("search", s.Search(st)))
+	r.Handle(prefix+"/request/id", s.rateLimit("request", s.RequestID(st)))
+	r.Handle(prefix+"/request/bestmatch", s.rateLimit("request", s.RequestBestMatch(st)))
+	r.Handle(prefix+"/request/queue", s.RequestQueue(st))
+	r.Handle(prefix+"/nowplaying/metadata", s.NowPlayingMetadata(st))
+	r.Handle(prefix+"/nowplaying/albumart", s.NowPlayingAlbumArt(st))
+	r.Handle(prefix+"/history", s.History(st))
+	r.Handle(prefix+"/listenurl", s.ListenURL(st))
+	r.Handle(prefix+"/listeners", s.Listeners(st))
+	r.Handle(prefix+"/bitrate", s.Bitrate(st))
+	r.Handle(prefix+"/library/artists", s.LibraryArtists(st))
+	r.Handle(prefix+"/library/artists/", s.LibraryArtistAlbums(st, prefix+"/library/artists/"))
+	r.Handle(prefix+"/library/albums/", s.LibraryAlbumTracks(st, prefix+"/library/albums/"))
+	r.Handle(prefix+"/library/genres", s.LibraryGenres(st))
+	r.Handle(prefix+"/library/years", s.LibraryYears(st))
+	r.Handle(prefix+"/stats/songs", s.StatsSongs(st))
+	r.Handle(prefix+"/stats/artists", s.StatsArtists(st))
+	r.Handle(prefix+"/stats/albums", s.StatsAlbums(st))
+	r.Handle(prefix+"/stats/requests", s.StatsRequests(st))
+	r.Handle(prefix+"/stats/listeners", s.StatsListeners(st))
+	r.Handle(prefix+"/stats/genres", s.StatsGenres(st))
+	if s.Config.DevMode {
+		r.Handle(prefix+"/dev/skip", s.DevSkip(st))
 	}
-	r.Handle("/", http.FileServer(http.Dir(c.RootPath+"./public/")))
-	return r
+}
+
+// Registers the admin API. Every admin route requires authentication.
+func (s *Server) adminRoutes(r *http.ServeMux) {
+	for _, st := range s.Stations {
+		s.adminStationRoutes(r, "/api/admin/"+st.Name, st)
+	}
+	s.adminStationRoutes(r, "/api/admin", s.defaultStation())
+	r.Handle("/api/admin/rescan", s.adminAuth(nil, nil, s.AdminRescan()))
+	r.Handle("/api/admin/reindex", s.adminAuth(nil, nil, s.AdminReindex()))
+	r.Handle("/api/admin/bans", s.adminAuth(nil, s.AdminBans(), nil))
+	r.Handle("/api/admin/ban", s.adminAuth(nil, nil, s.AdminBan()))
+	r.Handle("/api/admin/unban", s.adminAuth(nil, nil, s.AdminUnban()))
+	r.Handle("/api/admin/ratelimit", s.adminAuth(nil, s.AdminRateLimit(), s.AdminRateLimit()))
+	r.Handle("/api/admin/audit", s.adminAuth(nil, s.AdminAudit(), nil))
+}
+
+// Registers the admin routes of one station under a path prefix.
+func (s *Server) adminStationRoutes(r *http.ServeMux, prefix string, st *Station) {
+	r.Handle(prefix+"/skip", s.adminAuth(st, nil, s.AdminSkip(st)))
+	r.Handle(prefix+"/queue/clear", s.adminAuth(st, nil, s.AdminQueueClear(st)))
+	r.Handle(prefix+"/queue/cancel", s.adminAuth(st, nil, s.AdminQueueCancel(st)))
+	r.Handle(prefix+"/queue/move", s.adminAuth(st, nil, s.AdminQueueMove(st)))
 }
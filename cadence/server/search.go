@@ -0,0 +1,176 @@
+// search.go
+// Library search: free text across artist, title, album and genre, with field filters.
+//
+// A query is free text mixed with field:value terms, for example
+//
+//	blue artist:"miles davis" genre:jazz year:1955-1965
+//
+// Known fields are artist, title, album, genre and year. Years may be a single year or a range.
+// Values with spaces are quoted. Anything else is free text, which is matched by word prefix
+// and ranked by full-text rank and trigram similarity.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kenellorando/clog"
+)
+
+// Results returned by a search when the client does not ask for a page size, and the most it may ask for.
+const searchDefaultLimit = 50
+const searchMaxLimit = 200
+
+var searchFields = map[string]bool{"artist": true, "title": true, "album": true, "genre": true, "year": true}
+var searchWordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+var errInvalidSearch = errors.New("invalid search query")
+
+// A parsed search query.
+type searchQuery struct {
+	Text     string              // Free text, matched against every field.
+	Fields   map[string][]string // Text each named field must contain.
+	YearFrom int                 // Inclusive year range, zero when not filtered.
+	YearTo   int
+}
+
+// Splits a query on whitespace, keeping double-quoted runs together and dropping the quotes.
+func splitSearchTokens(query string) (tokens []string) {
+	var token strings.Builder
+	inQuote := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case unicode.IsSpace(r) && !inQuote:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// Parses a search query into free text and field filters.
+func parseSearchQuery(query string) (q searchQuery, err error) {
+	q.Fields = make(map[string][]string)
+	var text []string
+	for _, token := range splitSearchTokens(query) {
+		field, value, found := strings.Cut(token, ":")
+		field = strings.ToLower(field)
+		if !found || !searchFields[field] || strings.TrimSpace(value) == "" {
+			text = append(text, token)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if field != "year" {
+			q.Fields[field] = append(q.Fields[field], value)
+			continue
+		}
+		from, to, isRange := strings.Cut(value, "-")
+		if q.YearFrom, err = strconv.Atoi(from); err != nil {
+			return q, fmt.Errorf("%w: year <%s>", errInvalidSearch, value)
+		}
+		q.YearTo = q.YearFrom
+		if isRange {
+			if q.YearTo, err = strconv.Atoi(to); err != nil {
+				return q, fmt.Errorf("%w: year range <%s>", errInvalidSearch, value)
+			}
+		}
+		if q.YearFrom > q.YearTo {
+			q.YearFrom, q.YearTo = q.YearTo, q.YearFrom
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// Builds a Postgres tsquery which matches every word of the text by prefix.
+// Returns an empty string if the text has no words.
+func prefixTSQuery(text string) string {
+	words := searchWordPattern.FindAllString(strings.ToLower(text), -1)
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// Takes a station, a search query and a page of results to return.
+// Returns the page of songs, ordered by relevance, and the number of songs matching in total.
+func (s *Server) searchByQuery(st *Station, query string, limit int, offset int) (queryResults []SongData, total int, err error) {
+	clog.Debug("searchByQuery", fmt.Sprintf("Searching database for query: '%v'", query))
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	args := []interface{}{st.libraryPrefix(s.Config.MusicDir)}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conditions := []string{"($1 = '' OR starts_with(m.path, $1))", fmt.Sprintf("m.id NOT IN (SELECT song_id FROM %s)", bansTableName)}
+	order := "m.artist, m.album, m.title, m.id"
+	if q.Text != "" {
+		like := arg("%" + likeEscaper.Replace(q.Text) + "%")
+		text := arg(q.Text)
+		match := fmt.Sprintf("m.artist ILIKE %s OR m.title ILIKE %s OR m.album ILIKE %s OR m.genre ILIKE %s", like, like, like, like)
+		rank := fmt.Sprintf("GREATEST(similarity(m.artist, %s), similarity(m.title, %s), similarity(m.album, %s))", text, text, text)
+		if tsquery := prefixTSQuery(q.Text); tsquery != "" {
+			ts := fmt.Sprintf("to_tsquery('simple', %s)", arg(tsquery))
+			match = fmt.Sprintf("m.search @@ %s OR %s", ts, match)
+			rank = fmt.Sprintf("ts_rank(m.search, %s) + %s", ts, rank)
+		}
+		conditions = append(conditions, "("+match+")")
+		order = rank + " DESC, m.id"
+	}
+	for _, field := range []string{"artist", "title", "album", "genre"} {
+		for _, value := range q.Fields[field] {
+			conditions = append(conditions, fmt.Sprintf("m.%s ILIKE %s", field, arg("%"+likeEscaper.Replace(value)+"%")))
+		}
+	}
+	if q.YearFrom != 0 {
+		conditions = append(conditions, fmt.Sprintf("m.year BETWEEN %s AND %s", arg(q.YearFrom), arg(q.YearTo)))
+	}
+	selectStatement := fmt.Sprintf(`SELECT m.id, %s, COUNT(*) OVER () FROM %s m WHERE %s ORDER BY %s`,
+		songColumns, s.Config.PostgresTableName, strings.Join(conditions, " AND "), order)
+	countArgs := args
+	rows, err := s.DB.Query(selectStatement+fmt.Sprintf(" LIMIT %s OFFSET %s", arg(limit), arg(offset)), args...)
+	if err != nil {
+		clog.Error("searchByQuery", "Database search failed.", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	queryResults = []SongData{}
+	for rows.Next() {
+		var song SongData
+		targets := append([]interface{}{&song.ID}, songScanTargets(&song)...)
+		err = rows.Scan(append(targets, &total)...)
+		if err != nil {
+			clog.Error("searchByQuery", "Data scan failed.", err)
+			return nil, 0, err
+		}
+		queryResults = append(queryResults, song)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(queryResults) == 0 && offset > 0 {
+		if total, err = s.countRows(selectStatement, countArgs...); err != nil {
+			clog.Error("searchByQuery", "Failed to count search results.", err)
+			return nil, 0, err
+		}
+	}
+	return queryResults, total, nil
+}
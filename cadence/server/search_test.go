@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  searchQuery
+	}{
+		{"", searchQuery{Fields: map[string][]string{}}},
+		{"  blue   train ", searchQuery{Text: "blue train", Fields: map[string][]string{}}},
+		{`blue artist:"miles davis" Genre:jazz year:1955-1965`, searchQuery{Text: "blue",
+			Fields: map[string][]string{"artist": {"miles davis"}, "genre": {"jazz"}}, YearFrom: 1955, YearTo: 1965}},
+		{"year:1999 title:a title:b", searchQuery{Fields: map[string][]string{"title": {"a", "b"}}, YearFrom: 1999, YearTo: 1999}},
+		{"year:2000-1990", searchQuery{Fields: map[string][]string{}, YearFrom: 1990, YearTo: 2000}},
+		// Unknown fields and empty values are plain text.
+		{"mood:happy artist:", searchQuery{Text: "mood:happy artist:", Fields: map[string][]string{}}},
+	} {
+		got, err := parseSearchQuery(tc.query)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, %v, want %+v", tc.query, got, err, tc.want)
+		}
+	}
+	for _, query := range []string{"year:nineties", "year:1990-", "year:-1990"} {
+		if _, err := parseSearchQuery(query); !errors.Is(err, errInvalidSearch) {
+			t.Errorf("parseSearchQuery(%q) returned %v", query, err)
+		}
+	}
+}
+
+func TestPrefixTSQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"Blue Train":       "blue:* & train:*",
+		"AC/DC":            "ac:* & dc:*",
+		"'; DROP TABLE --": "drop:* & table:*",
+		"Sigur Rós 2":      "sigur:* & rós:* & 2:*",
+		"!!":               "",
+	} {
+		if got := prefixTSQuery(query); got != want {
+			t.Errorf("prefixTSQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	requirePostgres(t)
+	s, _, _ := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "a.mp3"), "Blue Train", "John Coltrane")
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "b.mp3"), "Blue in Green", "Miles Davis")
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "c.mp3"), "So What", "Miles Davis")
+	connectTestPostgres(t, s)
+
+	songs, total, err := s.searchByQuery(st, "blu", 1, 0)
+	if err != nil || total != 2 || len(songs) != 1 {
+		t.Errorf("blu found %+v of %d, %v", songs, total, err)
+	}
+	// A page past the last match still reports how many there are.
+	songs, total, err = s.searchByQuery(st, "blu", 10, 5)
+	if err != nil || total != 2 || len(songs) != 0 {
+		t.Errorf("blu past the last page found %+v of %d, %v", songs, total, err)
+	}
+	songs, total, err = s.searchByQuery(st, `blue artist:"miles davis"`, 10, 0)
+	if err != nil || total != 1 || len(songs) != 1 || songs[0].Title != "Blue in Green" {
+		t.Errorf("blue by miles davis found %+v of %d, %v", songs, total, err)
+	}
+	songs, _, err = s.searchByQuery(st, "100%", 10, 0)
+	if err != nil || len(songs) != 0 {
+		t.Errorf("100%% found %+v, %v", songs, err)
+	}
+}
@@ -0,0 +1,60 @@
+// server.go
+// Server state shared between the monitors and the API handlers.
+
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Server owns everything a running Cadence instance needs: its configuration,
+// database handles and the stations it serves.
+type Server struct {
+	Config   ServerConfig
+	DB       *sql.DB
+	Stations []*Station
+	metrics  *Metrics
+
+	// Serializes library scans, which may be started from main and the filesystem monitor.
+	indexMutex sync.Mutex
+	// Fills each art cache entry once, however many clients ask for it at the same time.
+	artFlights artFlights
+
+	rateLimiter RateLimiter
+	// Guards rateLimitPolicies. They start as configured and admins may change the request policy.
+	rateLimitMutex    sync.RWMutex
+	rateLimitPolicies map[string]RateLimitPolicy
+}
+
+func NewServer(config ServerConfig) *Server {
+	s := &Server{Config: config, rateLimiter: newRateLimiter(config), rateLimitPolicies: make(map[string]RateLimitPolicy)}
+	for route, policy := range config.RateLimitPolicies {
+		s.rateLimitPolicies[route] = policy
+	}
+	stations := config.Stations
+	if len(stations) == 0 {
+		stations = []StationConfig{defaultStationConfig(config)}
+	}
+	for _, sc := range stations {
+		s.Stations = append(s.Stations, NewStation(sc))
+	}
+	s.metrics = NewMetrics(s)
+	return s
+}
+
+// Returns the station served by the unscoped /api/... routes, which is the first one configured.
+func (s *Server) defaultStation() *Station {
+	return s.Stations[0]
+}
+
+// Stops the server's background connections.
+func (s *Server) Close() {
+	for _, st := range s.Stations {
+		st.Close()
+	}
+	s.rateLimiter.Close()
+	if s.DB != nil {
+		s.DB.Close()
+	}
+}
@@ -0,0 +1,298 @@
+// sse.go
+// Server-sent events for /api/{station}/radiodata/sse.
+//
+// Every change is sent as a nowplaying event holding a JSON snapshot of the station, alongside the
+// older title, artist, listeners, listenurl and history events, which carry plain strings.
+// A queue event tells clients to reload the request queue.
+// A client is sent the current state as soon as it connects. Reconnecting clients which send
+// Last-Event-ID are sent the events they missed instead, if they are recent enough to be kept.
+// With ?events=nowplaying,history a client receives only the named events.
+// The same events are sent to WebSocket clients, see websocket.go.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+// How many recent events are kept for clients which reconnect with Last-Event-ID.
+const sseReplaySize = 64
+
+// How many events may wait for a slow client before it is disconnected.
+const sseClientBuffer = 32
+
+// How often a comment is sent to idle clients, so proxies do not close the connection.
+const sseKeepAliveInterval = 30 * time.Second
+
+// The JSON data of the nowplaying event.
+type NowPlaying struct {
+	Song      SongData
+	ArtURL    string     // Empty if the song is not in the library. The song may still have no art, which is a 404.
+	StartedAt *time.Time // When the song started, if known.
+	Elapsed   float64    // Seconds since the song started.
+	ListenURL string     // Host and mount of the stream, empty while Icecast is unreachable.
+	Listeners int
+	Bitrate   float64
+}
+
+type sseMessage struct {
+	ID    string
+	Event string
+	Data  string
+	JSON  bool // Whether Data is a JSON document rather than plain text.
+}
+
+type sseClient struct {
+	messages chan sseMessage
+	events   map[string]bool // Events the client asked for, nil for all of them.
+}
+
+// SSEBroker sends a station's events to its connected event stream and WebSocket clients.
+type SSEBroker struct {
+	// Builds the events describing the current state, which clients are sent when they connect.
+	snapshot func() []sseMessage
+	// Distinguishes event IDs of this process from those a client saw before a restart.
+	epoch string
+
+	mu      sync.Mutex
+	nextID  uint64
+	recent  []sseMessage
+	clients map[*sseClient]bool
+	closed  bool
+}
+
+func NewSSEBroker(snapshot func() []sseMessage) *SSEBroker {
+	return &SSEBroker{
+		snapshot: snapshot,
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		clients:  make(map[*sseClient]bool),
+	}
+}
+
+// Sends an event to every connected client which wants it, and keeps it for replay.
+func (b *SSEBroker) SendEventMessage(data string, event string) {
+	b.send(sseMessage{Event: event, Data: data})
+}
+
+// Sends an event whose data is a JSON document.
+func (b *SSEBroker) SendJSONEvent(v interface{}, event string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.send(sseMessage{Event: event, Data: string(data), JSON: true})
+	return nil
+}
+
+func (b *SSEBroker) send(m sseMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.nextID++
+	m.ID = fmt.Sprintf("%s-%d", b.epoch, b.nextID)
+	b.recent = append(b.recent, m)
+	if len(b.recent) > sseReplaySize {
+		b.recent = b.recent[len(b.recent)-sseReplaySize:]
+	}
+	for c := range b.clients {
+		if !c.wants(m.Event) {
+			continue
+		}
+		select {
+		case c.messages <- m:
+		default:
+			// The client is not keeping up. It is disconnected, and may reconnect with Last-Event-ID.
+			delete(b.clients, c)
+			close(c.messages)
+		}
+	}
+}
+
+// Returns the number of connected clients.
+func (b *SSEBroker) ConsumersCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// Disconnects every client and stops accepting new ones.
+func (b *SSEBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		delete(b.clients, c)
+		close(c.messages)
+	}
+}
+
+// Takes the events a client asked for, separated by commas, or an empty string for all of them.
+func newSSEClient(filter string) *sseClient {
+	c := &sseClient{messages: make(chan sseMessage, sseClientBuffer)}
+	if filter != "" {
+		c.events = make(map[string]bool)
+		for _, event := range strings.Split(filter, ",") {
+			c.events[strings.TrimSpace(event)] = true
+		}
+	}
+	return c
+}
+
+func (c *sseClient) wants(event string) bool {
+	return c.events == nil || c.events[event]
+}
+
+// Registers a client. Returns the events it missed since lastEventID, or the current state if
+// it sent no ID or one too old to replay from.
+func (b *SSEBroker) subscribe(c *sseClient, lastEventID string) (backlog []sseMessage, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, false
+	}
+	b.clients[c] = true
+	missed, found := []sseMessage(nil), false
+	if lastEventID != "" {
+		for i, m := range b.recent {
+			if m.ID == lastEventID {
+				missed, found = b.recent[i+1:], true
+				break
+			}
+		}
+	}
+	if !found {
+		// The snapshot carries the ID of the latest event, so a client reconnecting later
+		// is replayed what it missed from here.
+		latest := ""
+		if len(b.recent) > 0 {
+			latest = b.recent[len(b.recent)-1].ID
+		}
+		for _, m := range b.snapshot() {
+			m.ID = latest
+			missed = append(missed, m)
+		}
+	}
+	for _, m := range missed {
+		if c.wants(m.Event) {
+			backlog = append(backlog, m)
+		}
+	}
+	return backlog, true
+}
+
+func (b *SSEBroker) unsubscribe(c *sseClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[c] {
+		delete(b.clients, c)
+		close(c.messages)
+	}
+}
+
+// GET /api/{station}/radiodata/sse?events=
+// Streams the station's events. events optionally lists the events to receive, separated by commas.
+func (b *SSEBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		clog.Error("SSE", "The response writer does not support streaming.", nil)
+		w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+		return
+	}
+	c := newSSEClient(r.URL.Query().Get("events"))
+	backlog, ok := b.subscribe(c, r.Header.Get("Last-Event-ID"))
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable) // 503 Service Unavailable
+		return
+	}
+	defer b.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK) // 200 OK
+	for _, m := range backlog {
+		writeSSEMessage(w, m)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case m, open := <-c.messages:
+			if !open {
+				return
+			}
+			writeSSEMessage(w, m)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSEMessage(w http.ResponseWriter, m sseMessage) {
+	if m.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", m.ID)
+	}
+	fmt.Fprintf(w, "event: %s\n", m.Event)
+	for _, line := range strings.Split(m.Data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// Returns the nowplaying snapshot of the station's current state.
+func (st *Station) nowPlayingEvent() NowPlaying {
+	now := st.nowPlaying()
+	event := NowPlaying{Song: now.Song, Listeners: int(now.Listeners), Bitrate: now.Bitrate}
+	if now.Song.ID != 0 {
+		event.ArtURL = fmt.Sprintf("/api/art/%d", now.Song.ID)
+	}
+	if !now.startedAt.IsZero() {
+		startedAt := now.startedAt
+		event.StartedAt = &startedAt
+		event.Elapsed = time.Since(startedAt).Seconds()
+	}
+	if now.Host != "" && now.Host != "-" {
+		event.ListenURL = now.Host + "/" + now.Mountpoint
+	}
+	return event
+}
+
+// Sends the station's current state to its clients as a nowplaying event.
+func (st *Station) publishNowPlaying() {
+	if err := st.SSE.SendJSONEvent(st.nowPlayingEvent(), "nowplaying"); err != nil {
+		clog.Error("publishNowPlaying", "Failed to marshal now playing.", err)
+	}
+}
+
+// The events a client is sent when it connects: the nowplaying snapshot, and the older events for clients which use those.
+func (st *Station) sseSnapshot() []sseMessage {
+	now := st.nowPlaying()
+	data, err := json.Marshal(st.nowPlayingEvent())
+	if err != nil {
+		clog.Error("sseSnapshot", "Failed to marshal now playing.", err)
+		return nil
+	}
+	return []sseMessage{
+		{Event: "nowplaying", Data: string(data), JSON: true},
+		{Event: "title", Data: now.Song.Title},
+		{Event: "artist", Data: now.Song.Artist},
+		{Event: "listeners", Data: fmt.Sprint(now.Listeners)},
+		{Event: "listenurl", Data: now.Host + "/" + now.Mountpoint},
+	}
+}
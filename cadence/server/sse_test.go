@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSSESnapshotOnConnect(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	var prev RadioInfo
+	fakeIC.SetPlaying("Song", "Artist", 4)
+	s.icecastCheck(st, &prev)
+
+	events := subscribeSSEWith(t, st, "", nil)
+	e := expectSSE(t, events, "nowplaying")
+	var now NowPlaying
+	if err := json.Unmarshal([]byte(e.Data), &now); err != nil {
+		t.Fatalf("nowplaying carried %q: %v", e.Data, err)
+	}
+	if now.Song.Title != "Song" || now.Song.Artist != "Artist" || now.Listeners != 4 || now.StartedAt == nil {
+		t.Errorf("nowplaying is %+v", now)
+	}
+	if e := expectSSE(t, events, "title"); e.Data != "Song" {
+		t.Errorf("title carried %q", e.Data)
+	}
+	if e := expectSSE(t, events, "listenurl"); e.Data != now.ListenURL || e.Data != "stream.example.com/cadence1" {
+		t.Errorf("listenurl carried %q, nowplaying %q", e.Data, now.ListenURL)
+	}
+}
+
+func TestSSEReplay(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	var prev RadioInfo
+	fakeIC.SetPlaying("First Song", "Artist", 1)
+	s.icecastCheck(st, &prev)
+	first := expectSSE(t, subscribeSSEWith(t, st, "", nil), "nowplaying")
+	if first.ID == "" {
+		t.Fatal("nowplaying has no ID")
+	}
+	fakeIC.SetPlaying("Second Song", "Artist", 1)
+	s.icecastCheck(st, &prev)
+
+	// A client reconnecting after the first song is sent what it missed, and nothing else.
+	events := subscribeSSEWith(t, st, "?events=title", http.Header{"Last-Event-ID": {first.ID}})
+	if e := expectSSE(t, events, "title"); e.Data != "Second Song" || e.ID == first.ID {
+		t.Errorf("replayed title is %+v", e)
+	}
+	st.SSE.SendEventMessage("5", "listeners")
+	st.SSE.SendEventMessage("Third Song", "title")
+	if e := <-events; e.Event != "title" || e.Data != "Third Song" {
+		t.Errorf("filtered client received %+v", e)
+	}
+
+	// An ID the server does not know, as after a restart, gets the current state instead.
+	events = subscribeSSEWith(t, st, "?events=nowplaying", http.Header{"Last-Event-ID": {"unknown-1"}})
+	var now NowPlaying
+	if err := json.Unmarshal([]byte(expectSSE(t, events, "nowplaying").Data), &now); err != nil || now.Song.Title != "Second Song" {
+		t.Errorf("nowplaying after an unknown ID is %+v, %v", now, err)
+	}
+}
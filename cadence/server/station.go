@@ -0,0 +1,141 @@
+// station.go
+// Stations: one Liquidsoap source and Icecast mount each, served from one Cadence server.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Station names become the first segment of their API routes (/api/{station}/...),
+// so they may not collide with the paths of routes which are not station scoped.
+var stationNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+var reservedStationNames = map[string]bool{
+	"radiodata": true, "search": true, "request": true, "nowplaying": true, "history": true,
+	"listenurl": true, "listeners": true, "bitrate": true, "version": true, "dev": true, "stations": true,
+	"admin": true, "stats": true, "library": true, "art": true, "internal": true, "ws": true,
+}
+
+type StationConfig struct {
+	Name              string
+	LiquidsoapAddress string // Liquidsoap telnet server, host:port.
+	IcecastAddress    string // Icecast server, host:port.
+	Mountpoint        string // Icecast mount the station's stream is served on.
+	Output            string // ID of the Liquidsoap output, used for commands such as skip.
+	RequestQueue      string // ID of the Liquidsoap request.queue source requests are pushed to.
+	LibraryDir        string // Directory under the music directory this station plays from, empty for all of it.
+}
+
+// Station holds the live state of one station.
+type Station struct {
+	StationConfig
+	Liquidsoap *LiquidsoapClient
+	SSE        *SSEBroker
+
+	// Guards now.
+	mu  sync.RWMutex
+	now RadioInfo
+
+	// Serializes changes to the station's request queue between the handlers and the sync loop.
+	queueMutex sync.Mutex
+	// Serializes syncs with Liquidsoap, which talk to it without holding queueMutex.
+	syncMutex sync.Mutex
+}
+
+func NewStation(config StationConfig) *Station {
+	st := &Station{
+		StationConfig: config,
+		Liquidsoap:    NewLiquidsoapClient(config.LiquidsoapAddress, liquidsoapTimeout),
+	}
+	st.SSE = NewSSEBroker(st.sseSnapshot)
+	return st
+}
+
+// Reads station configuration from the environment.
+// CSERVER_STATIONS lists station names, separated by commas. Each station may override
+// the server-wide defaults with CSERVER_STATION_<NAME>_<SETTING> variables. Without
+// CSERVER_STATIONS a single station named cadence1 is configured from the defaults.
+func stationConfigsFromEnv(c ServerConfig) (stations []StationConfig, err error) {
+	names := strings.Split(os.Getenv("CSERVER_STATIONS"), ",")
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !stationNamePattern.MatchString(name) || reservedStationNames[name] {
+			return nil, fmt.Errorf("invalid station name <%s>", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("station <%s> is configured twice", name)
+		}
+		seen[name] = true
+		env := func(setting string, fallback string) string {
+			key := "CSERVER_STATION_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + setting
+			if value, ok := os.LookupEnv(key); ok {
+				return value
+			}
+			return fallback
+		}
+		stations = append(stations, StationConfig{
+			Name:              name,
+			LiquidsoapAddress: env("LIQUIDSOAPADDRESS", c.LiquidsoapAddress+c.LiquidsoapPort),
+			IcecastAddress:    env("ICECASTADDRESS", c.IcecastAddress+c.IcecastPort),
+			Mountpoint:        env("MOUNTPOINT", name),
+			Output:            env("OUTPUT", name),
+			RequestQueue:      env("REQUESTQUEUE", "request"),
+			LibraryDir:        env("LIBRARY", ""),
+		})
+	}
+	if len(stations) == 0 {
+		stations = append(stations, defaultStationConfig(c))
+	}
+	return stations, nil
+}
+
+// The single station a server has when no stations are configured.
+func defaultStationConfig(c ServerConfig) StationConfig {
+	return StationConfig{
+		Name:              "cadence1",
+		LiquidsoapAddress: c.LiquidsoapAddress + c.LiquidsoapPort,
+		IcecastAddress:    c.IcecastAddress + c.IcecastPort,
+		Mountpoint:        "cadence1",
+		Output:            "cadence1",
+		RequestQueue:      "request",
+	}
+}
+
+// Returns the path prefix of the files this station may play, or an empty string if it plays the whole library.
+func (st *Station) libraryPrefix(musicDir string) string {
+	if st.LibraryDir == "" {
+		return ""
+	}
+	return filepath.Join(musicDir, st.LibraryDir) + string(os.PathSeparator)
+}
+
+// Returns a copy of the now playing state.
+func (st *Station) nowPlaying() RadioInfo {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.now
+}
+
+// Changes the now playing state under the station's lock, so that Icecast polls and
+// Liquidsoap's track callbacks do not overwrite each other. Returns the state before and after the change.
+func (st *Station) updateNowPlaying(update func(now *RadioInfo)) (prev RadioInfo, now RadioInfo) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	prev = st.now
+	update(&st.now)
+	return prev, st.now
+}
+
+func (st *Station) Close() {
+	st.Liquidsoap.Close()
+	st.SSE.Close()
+}
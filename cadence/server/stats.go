@@ -0,0 +1,340 @@
+// stats.go
+// Station statistics: listener samples and aggregates over the play history for dashboards.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+const listenerSamplesTableName = "listener_samples"
+
+// How often each station's listener count is stored.
+const listenerSampleInterval = time.Minute
+
+// The window statistics are computed over when a request does not give one.
+const statsDefaultWindow = 7 * 24 * time.Hour
+
+type SongStat struct {
+	SongID *int
+	Title  string
+	Artist string
+	Plays  int
+}
+
+type ArtistStat struct {
+	Artist string
+	Plays  int
+}
+
+type AlbumStat struct {
+	AlbumID int
+	Album   string
+	Artist  string
+	Plays   int
+}
+
+type RequestStat struct {
+	Song     SongData
+	Requests int
+}
+
+type ListenerStat struct {
+	Hour    time.Time
+	Peak    int
+	Average float64
+	Samples int
+}
+
+type GenreStat struct {
+	Genre   string
+	Airtime float64 // Seconds played within the window.
+	Plays   int
+}
+
+// The span and number of results a statistics request asks for.
+type statsWindow struct {
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// Stores a station's listener count at the given time.
+func (s *Server) statsRecordListeners(st *Station, listeners int, at time.Time) error {
+	if s.DB == nil {
+		return nil
+	}
+	_, err := s.DB.Exec(fmt.Sprintf("INSERT INTO %s (station, sampled_at, listeners) VALUES ($1, $2, $3)", listenerSamplesTableName),
+		st.Name, at, listeners)
+	if err != nil {
+		clog.Error("statsRecordListeners", "Failed to store listener sample.", err)
+	}
+	return err
+}
+
+// Returns the songs played most often within the window.
+func (s *Server) statsTopSongs(st *Station, window statsWindow) (stats []SongStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT MAX(song_id), title, artist, COUNT(*) AS plays FROM %s
+	WHERE station = $1 AND started_at >= $2 AND started_at < $3
+	GROUP BY title, artist ORDER BY plays DESC, title, artist LIMIT $4`, historyTableName),
+		st.Name, window.Since, window.Until, window.Limit)
+	if err != nil {
+		clog.Error("statsTopSongs", "Failed to query the play history.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []SongStat{}
+	for rows.Next() {
+		var stat SongStat
+		var songID sql.NullInt64
+		if err = rows.Scan(&songID, &stat.Title, &stat.Artist, &stat.Plays); err != nil {
+			clog.Error("statsTopSongs", "Data scan failed.", err)
+			return nil, err
+		}
+		if songID.Valid {
+			id := int(songID.Int64)
+			stat.SongID = &id
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the artists played most often within the window.
+func (s *Server) statsTopArtists(st *Station, window statsWindow) (stats []ArtistStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT artist, COUNT(*) AS plays FROM %s
+	WHERE station = $1 AND started_at >= $2 AND started_at < $3
+	GROUP BY artist ORDER BY plays DESC, artist LIMIT $4`, historyTableName),
+		st.Name, window.Since, window.Until, window.Limit)
+	if err != nil {
+		clog.Error("statsTopArtists", "Failed to query the play history.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []ArtistStat{}
+	for rows.Next() {
+		var stat ArtistStat
+		if err = rows.Scan(&stat.Artist, &stat.Plays); err != nil {
+			clog.Error("statsTopArtists", "Data scan failed.", err)
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the albums played most often within the window. Only plays of songs found in the library count.
+func (s *Server) statsTopAlbums(st *Station, window statsWindow) (stats []AlbumStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT al.id, al.title, ar.name, COUNT(*) AS plays
+	FROM %s h JOIN %s m ON m.id = h.song_id JOIN %s al ON al.id = m.album_id JOIN %s ar ON ar.id = al.artist_id
+	WHERE h.station = $1 AND h.started_at >= $2 AND h.started_at < $3
+	GROUP BY al.id, ar.name ORDER BY plays DESC, al.title, ar.name LIMIT $4`,
+		historyTableName, s.Config.PostgresTableName, albumsTableName, artistsTableName),
+		st.Name, window.Since, window.Until, window.Limit)
+	if err != nil {
+		clog.Error("statsTopAlbums", "Failed to query the play history.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []AlbumStat{}
+	for rows.Next() {
+		var stat AlbumStat
+		if err = rows.Scan(&stat.AlbumID, &stat.Album, &stat.Artist, &stat.Plays); err != nil {
+			clog.Error("statsTopAlbums", "Data scan failed.", err)
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the songs requested most often within the window. Cancelled requests do not count.
+func (s *Server) statsTopRequests(st *Station, window statsWindow) (stats []RequestStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT q.song_id, %s, COUNT(*) AS requests
+	FROM %s q LEFT JOIN %s m ON m.id = q.song_id
+	WHERE q.station = $1 AND q.requested_at >= $2 AND q.requested_at < $3 AND q.status <> $5
+	GROUP BY q.song_id, m.id ORDER BY requests DESC, q.song_id LIMIT $4`,
+		songColumns, queueTableName, s.Config.PostgresTableName),
+		st.Name, window.Since, window.Until, window.Limit, queueStatusCancelled)
+	if err != nil {
+		clog.Error("statsTopRequests", "Failed to query the request queue.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []RequestStat{}
+	for rows.Next() {
+		var stat RequestStat
+		targets := append([]interface{}{&stat.Song.ID}, songScanTargets(&stat.Song)...)
+		err = rows.Scan(append(targets, &stat.Requests)...)
+		if err != nil {
+			clog.Error("statsTopRequests", "Data scan failed.", err)
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the peak and average listener count of each hour within the window, oldest first.
+func (s *Server) statsListeners(st *Station, window statsWindow) (stats []ListenerStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT date_trunc('hour', sampled_at) AS hour, MAX(listeners), AVG(listeners), COUNT(*) FROM %s
+	WHERE station = $1 AND sampled_at >= $2 AND sampled_at < $3
+	GROUP BY hour ORDER BY hour`, listenerSamplesTableName),
+		st.Name, window.Since, window.Until)
+	if err != nil {
+		clog.Error("statsListeners", "Failed to query listener samples.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []ListenerStat{}
+	for rows.Next() {
+		var stat ListenerStat
+		if err = rows.Scan(&stat.Hour, &stat.Peak, &stat.Average, &stat.Samples); err != nil {
+			clog.Error("statsListeners", "Data scan failed.", err)
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns how long songs of each genre were on air within the window, longest first.
+// Plays which started before or ended after the window only count for the time inside it.
+func (s *Server) statsGenres(st *Station, window statsWindow) (stats []GenreStat, err error) {
+	rows, err := s.DB.Query(fmt.Sprintf(`SELECT COALESCE(NULLIF(m.genre, ''), 'Unknown') AS genre,
+	SUM(EXTRACT(EPOCH FROM LEAST(COALESCE(h.ended_at, now()), $3) - GREATEST(h.started_at, $2)))::float8 AS airtime,
+	COUNT(*) FROM %s h LEFT JOIN %s m ON m.id = h.song_id
+	WHERE h.station = $1 AND h.started_at < $3 AND (h.ended_at IS NULL OR h.ended_at > $2)
+	GROUP BY 1 ORDER BY airtime DESC, genre LIMIT $4`, historyTableName, s.Config.PostgresTableName),
+		st.Name, window.Since, window.Until, window.Limit)
+	if err != nil {
+		clog.Error("statsGenres", "Failed to query the play history.", err)
+		return nil, err
+	}
+	defer rows.Close()
+	stats = []GenreStat{}
+	for rows.Next() {
+		var stat GenreStat
+		if err = rows.Scan(&stat.Genre, &stat.Airtime, &stat.Plays); err != nil {
+			clog.Error("statsGenres", "Data scan failed.", err)
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Reads the since, until and limit query parameters of a statistics request.
+// The window defaults to the last week and the limit to 10, at most 100.
+func parseStatsWindow(r *http.Request) (window statsWindow, err error) {
+	query := r.URL.Query()
+	window.Until, window.Limit = time.Now(), 10
+	if v := query.Get("until"); v != "" {
+		if window.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return window, err
+		}
+	}
+	window.Since = window.Until.Add(-statsDefaultWindow)
+	if v := query.Get("since"); v != "" {
+		if window.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return window, err
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if window.Limit, err = strconv.Atoi(v); err != nil {
+			return window, err
+		}
+		if window.Limit < 1 {
+			return window, fmt.Errorf("limit <%d> is not positive", window.Limit)
+		}
+		if window.Limit > 100 {
+			window.Limit = 100
+		}
+	}
+	return window, nil
+}
+
+// Serves one statistics endpoint. Each takes the since, until and limit query parameters
+// described by parseStatsWindow and responds with a JSON array.
+func (s *Server) statsHandler(caller string, st *Station, query func(*Station, statsWindow) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window, err := parseStatsWindow(r)
+		if err != nil {
+			clog.Debug(caller, fmt.Sprintf("Invalid statistics window: %v", err))
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		stats, err := query(st, window)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		jsonMarshal, err := json.Marshal(stats)
+		if err != nil {
+			clog.Error(caller, "Failed to marshal statistics.", err)
+			w.WriteHeader(http.StatusInternalServerError) // 500 Internal Server Error
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(jsonMarshal)
+		if err != nil {
+			clog.Error(caller, "Failed to write response.", err)
+			return
+		}
+	}
+}
+
+// GET /api/{station}/stats/songs?since=&until=&limit=
+// Gets the songs played most often.
+func (s *Server) StatsSongs(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsSongs", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsTopSongs(st, window)
+	})
+}
+
+// GET /api/{station}/stats/artists?since=&until=&limit=
+// Gets the artists played most often.
+func (s *Server) StatsArtists(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsArtists", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsTopArtists(st, window)
+	})
+}
+
+// GET /api/{station}/stats/albums?since=&until=&limit=
+// Gets the albums played most often.
+func (s *Server) StatsAlbums(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsAlbums", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsTopAlbums(st, window)
+	})
+}
+
+// GET /api/{station}/stats/requests?since=&until=&limit=
+// Gets the songs requested most often.
+func (s *Server) StatsRequests(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsRequests", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsTopRequests(st, window)
+	})
+}
+
+// GET /api/{station}/stats/listeners?since=&until=
+// Gets the peak and average listener count of each hour, oldest first.
+func (s *Server) StatsListeners(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsListeners", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsListeners(st, window)
+	})
+}
+
+// GET /api/{station}/stats/genres?since=&until=&limit=
+// Gets the total airtime of each genre in seconds, longest first.
+func (s *Server) StatsGenres(st *Station) http.HandlerFunc {
+	return s.statsHandler("StatsGenres", st, func(st *Station, window statsWindow) (interface{}, error) {
+		return s.statsGenres(st, window)
+	})
+}
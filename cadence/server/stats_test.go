@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStatsWindow(t *testing.T) {
+	window, err := parseStatsWindow(httptest.NewRequest(http.MethodGet, "/api/stats/songs", nil))
+	if err != nil || window.Limit != 10 || window.Until.Sub(window.Since) != statsDefaultWindow {
+		t.Errorf("default window is %+v, %v", window, err)
+	}
+	window, err = parseStatsWindow(httptest.NewRequest(http.MethodGet,
+		"/api/stats/songs?since=2024-01-01T00:00:00Z&until=2024-01-02T00:00:00Z&limit=500", nil))
+	if err != nil || window.Limit != 100 || !window.Since.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!window.Until.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("window is %+v, %v", window, err)
+	}
+	for _, query := range []string{"since=yesterday", "until=1", "limit=0", "limit=ten"} {
+		if _, err := parseStatsWindow(httptest.NewRequest(http.MethodGet, "/api/stats/songs?"+query, nil)); err == nil {
+			t.Errorf("%s was accepted", query)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	requirePostgres(t)
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	s.Config.MusicDir = t.TempDir()
+	writeTaggedMP3(t, filepath.Join(s.Config.MusicDir, "song.mp3"), "Hit", "Artist A")
+	connectTestPostgres(t, s)
+
+	var prev RadioInfo
+	for _, song := range []struct{ title, artist string }{
+		{"Hit", "Artist A"}, {"Other", "Artist B"}, {"Hit", "Artist A"}, {"Another", "Artist A"},
+	} {
+		fakeIC.SetPlaying(song.title, song.artist, 5)
+		s.icecastCheck(st, &prev)
+	}
+	s.statsRecordListeners(st, 4, time.Now())
+	s.statsRecordListeners(st, 8, time.Now())
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s returned %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	var songs []SongStat
+	get("/api/stats/songs", &songs)
+	if len(songs) != 3 || songs[0].Title != "Hit" || songs[0].Plays != 2 || songs[0].SongID == nil {
+		t.Errorf("top songs are %+v", songs)
+	}
+	var artists []ArtistStat
+	get("/api/cadence1/stats/artists?limit=1", &artists)
+	if len(artists) != 1 || artists[0].Artist != "Artist A" || artists[0].Plays != 3 {
+		t.Errorf("top artists are %+v", artists)
+	}
+	// Untagged songs in the library and songs not in it are counted together.
+	var genres []GenreStat
+	get("/api/stats/genres", &genres)
+	if len(genres) != 1 || genres[0].Genre != "Unknown" || genres[0].Plays != 4 {
+		t.Errorf("genres are %+v", genres)
+	}
+	var listeners []ListenerStat
+	get("/api/stats/listeners", &listeners)
+	if len(listeners) != 1 || listeners[0].Peak != 8 || listeners[0].Average != 6 || listeners[0].Samples != 2 {
+		t.Errorf("listeners are %+v", listeners)
+	}
+}
@@ -0,0 +1,83 @@
+// track.go
+// Now playing updates pushed by Liquidsoap's on_track hook.
+//
+// When CSERVER_TRACK_SECRET is set, Liquidsoap reports every track as it starts, and Icecast
+// is polled only for listener counts. Without it, now playing follows the Icecast status page.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kenellorando/clog"
+)
+
+// Reports whether Liquidsoap reports tracks to Cadence. Without a secret the track callback is not served.
+func (s *Server) trackPushEnabled() bool {
+	return s.Config.TrackSecret != ""
+}
+
+// POST /api/internal/{station}/track
+// Called by Liquidsoap's on_track hook with the metadata of the track which started playing,
+// as a JSON object of strings such as {"filename": "/music/song.mp3", "title": "...", "artist": "..."}.
+// Requires "Authorization: Bearer <CSERVER_TRACK_SECRET>".
+func (s *Server) InternalTrack(st *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed) // 405 Method Not Allowed
+			return
+		}
+		secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s.Config.TrackSecret)) != 1 {
+			clog.Warn("InternalTrack", fmt.Sprintf("Rejected track update without the track secret from client %s.", r.RemoteAddr))
+			w.WriteHeader(http.StatusUnauthorized) // 401 Unauthorized
+			return
+		}
+		var metadata map[string]string
+		err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&metadata)
+		if err != nil {
+			clog.Debug("InternalTrack", fmt.Sprintf("Unable to decode track metadata: %v", err))
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+		path := strings.TrimPrefix(metadata["filename"], "file://")
+		title, artist, rid := metadata["title"], metadata["artist"], metadata["rid"]
+		if path == "" && title == "" {
+			w.WriteHeader(http.StatusBadRequest) // 400 Bad Request
+			return
+		}
+
+		// on_track fires again for the track on air when its metadata is refreshed, and the hook may
+		// retry a callback. Neither is a new play, so neither is announced or recorded. A song played
+		// again straight after itself is a new request, which Liquidsoap gives a new rid.
+		repeated := func(now RadioInfo) bool {
+			return now.streamPath == path && now.streamTitle == title && now.streamArtist == artist && now.streamRID == rid
+		}
+		if repeated(st.nowPlaying()) {
+			clog.Debug("InternalTrack", fmt.Sprintf("Ignored a repeated track update for <%s>.", path))
+			w.WriteHeader(http.StatusNoContent) // 204 No Content
+			return
+		}
+		song := s.resolveSong(st, path, title, artist)
+		changed := false
+		prev, now := st.updateNowPlaying(func(now *RadioInfo) {
+			if repeated(*now) {
+				return
+			}
+			changed = true
+			now.Song = song
+			now.streamTitle, now.streamArtist, now.streamPath, now.streamRID = title, artist, path, rid
+			now.startedAt = time.Now()
+		})
+		if changed {
+			s.announceTrack(st, prev, now)
+		}
+		w.WriteHeader(http.StatusNoContent) // 204 No Content
+	}
+}
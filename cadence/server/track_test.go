@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInternalTrack(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	s.Config.TrackSecret = "secret"
+	st := s.defaultStation()
+	events := subscribeSSE(t, st)
+	routes := s.routes()
+	post := func(auth string, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/internal/track", strings.NewReader(body))
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	track := `{"filename": "/music/song.mp3", "title": "Pushed Song", "artist": "Pushed Artist", "rid": "3"}`
+	for _, tc := range []struct {
+		auth string
+		body string
+		want int
+	}{
+		{"", track, http.StatusUnauthorized},
+		{"Bearer wrong", track, http.StatusUnauthorized},
+		{"Bearer secret", "not json", http.StatusBadRequest},
+		{"Bearer secret", `{}`, http.StatusBadRequest},
+		{"Bearer secret", track, http.StatusNoContent},
+	} {
+		if got := post(tc.auth, tc.body); got != tc.want {
+			t.Errorf("track update with %q and %s returned %d, expected %d", tc.auth, tc.body, got, tc.want)
+		}
+	}
+	if e := expectSSE(t, events, "title"); e.Data != "Pushed Song" {
+		t.Errorf("title event carried %q", e.Data)
+	}
+	// The same track reported again is not a new play.
+	if got := post("Bearer secret", track); got != http.StatusNoContent {
+		t.Errorf("repeated track update returned %d", got)
+	}
+	for timeout := time.After(200 * time.Millisecond); ; {
+		select {
+		case e := <-events:
+			if e.Event == "title" {
+				t.Errorf("repeated track update was announced: %+v", e)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	// The same song requested again is a new play, which Liquidsoap gives a new rid.
+	if got := post("Bearer secret", strings.Replace(track, `"3"`, `"4"`, 1)); got != http.StatusNoContent {
+		t.Errorf("track update for a new request returned %d", got)
+	}
+	if e := expectSSE(t, events, "title"); e.Data != "Pushed Song" {
+		t.Errorf("title event carried %q", e.Data)
+	}
+
+	// Icecast is only asked for listener counts, and losing it does not lose the track.
+	var prev RadioInfo
+	fakeIC.SetPlaying("Stale Song", "Stale Artist", 7)
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.Title != "Pushed Song" || now.Listeners != 7 {
+		t.Errorf("now playing is %+v", now)
+	}
+	fakeIC.SetStatus(http.StatusServiceUnavailable, "")
+	s.icecastCheck(st, &prev)
+	if now := st.nowPlaying(); now.Song.Title != "Pushed Song" || now.Listeners != -1 {
+		t.Errorf("now playing after losing Icecast is %+v", now)
+	}
+}
+
+func TestInternalTrackDisabled(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/internal/track", strings.NewReader(`{"title": "Song"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("track update without a configured secret returned %d", rec.Code)
+	}
+}
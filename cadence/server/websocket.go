@@ -0,0 +1,239 @@
+// websocket.go
+// WebSocket API at /api/{station}/ws.
+//
+// A WebSocket client is sent the same events as the event stream, as JSON messages:
+//
+//	{"type": "event", "id": "...", "event": "nowplaying", "data": {...}}
+//
+// where data is a JSON document for nowplaying and a string for the older events. The current
+// state is sent on connecting, and ?events= and ?lastEventId= work as they do for the event stream.
+//
+// Clients may send commands, each answered with the status, headers and body its HTTP route would give:
+//
+//	{"type": "search", "id": "1", "search": "queen", "limit": 10, "offset": 0}
+//	{"type": "request", "id": "2", "song": 42}
+//	{"type": "requestbestmatch", "id": "3", "search": "bohemian rhapsody"}
+//	{"type": "response", "id": "2", "status": 202, "headers": {...}, "body": {...}}
+//
+// Commands are served by the same handlers as the HTTP routes, so requests are rate limited the same way.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kenellorando/clog"
+)
+
+// How long a write to a WebSocket client may take, and how long a client may go without answering pings.
+const wsWriteTimeout = 10 * time.Second
+const wsPongTimeout = 2 * sseKeepAliveInterval
+
+// The largest command a client may send.
+const wsMaxCommandSize = 4096
+
+var errUnknownCommand = errors.New("unknown command")
+
+// Browsers may only connect from a page served by the same host, so a proxy in front of Cadence
+// must pass the Host header on unchanged (see config/nginx.conf.example).
+var wsUpgrader = websocket.Upgrader{}
+
+// A command sent by a WebSocket client.
+type wsCommand struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Search string `json:"search"`
+	Song   int    `json:"song"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// A message sent to a WebSocket client.
+type wsMessage struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	Event   string            `json:"event,omitempty"`
+	Data    interface{}       `json:"data,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// GET /api/{station}/ws?events=&lastEventId=
+// Upgrades to a WebSocket which carries the station's events and accepts search and request commands.
+func (s *Server) WebSocket(st *Station) http.HandlerFunc {
+	commands := map[string]http.Handler{
+		"search":           s.rateLimit("search", s.Search(st)),
+		"request":          s.rateLimit("request", s.RequestID(st)),
+		"requestbestmatch": s.rateLimit("request", s.RequestBestMatch(st)),
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		lastEventID := r.URL.Query().Get("lastEventId")
+		if lastEventID == "" {
+			lastEventID = r.Header.Get("Last-Event-ID")
+		}
+		// The upgrader has already replied to requests it rejects.
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			clog.Debug("WebSocket", fmt.Sprintf("Unable to upgrade connection from client %s: %v", r.RemoteAddr, err))
+			return
+		}
+		defer conn.Close()
+		c := newSSEClient(r.URL.Query().Get("events"))
+		backlog, ok := st.SSE.subscribe(c, lastEventID)
+		if !ok {
+			return
+		}
+		defer st.SSE.unsubscribe(c)
+
+		replies := make(chan wsMessage)
+		done, stop := make(chan struct{}), make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer close(done)
+			conn.SetReadLimit(wsMaxCommandSize)
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			})
+			for {
+				var command wsCommand
+				var reply wsMessage
+				if err := conn.ReadJSON(&command); err == nil {
+					reply = s.wsServeCommand(r, commands, command)
+				} else {
+					// Anything but a malformed command means the connection is gone.
+					var syntaxErr *json.SyntaxError
+					var typeErr *json.UnmarshalTypeError
+					if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+						return
+					}
+					reply = wsMessage{Type: "error", Error: "invalid command"}
+				}
+				select {
+				case replies <- reply:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		write := func(m wsMessage) bool {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			return conn.WriteJSON(m) == nil
+		}
+		for _, m := range backlog {
+			if !write(wsEvent(m)) {
+				return
+			}
+		}
+		ping := time.NewTicker(sseKeepAliveInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case m, open := <-c.messages:
+				if !open || !write(wsEvent(m)) {
+					return
+				}
+			case m := <-replies:
+				if !write(m) {
+					return
+				}
+			case <-ping.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// Converts an event for a WebSocket client.
+func wsEvent(m sseMessage) wsMessage {
+	var data interface{} = m.Data
+	if m.JSON {
+		data = json.RawMessage(m.Data)
+	}
+	return wsMessage{Type: "event", ID: m.ID, Event: m.Event, Data: data}
+}
+
+// Serves a command with the handler of its HTTP route, on behalf of the client of the WebSocket request.
+func (s *Server) wsServeCommand(r *http.Request, commands map[string]http.Handler, command wsCommand) wsMessage {
+	handler, ok := commands[command.Type]
+	if !ok {
+		return wsMessage{Type: "error", ID: command.ID, Error: errUnknownCommand.Error()}
+	}
+	var body interface{}
+	query := url.Values{}
+	switch command.Type {
+	case "search":
+		body = map[string]string{"search": command.Search}
+		if command.Limit > 0 {
+			query.Set("limit", strconv.Itoa(command.Limit))
+		}
+		if command.Offset > 0 {
+			query.Set("offset", strconv.Itoa(command.Offset))
+		}
+	case "request":
+		body = map[string]string{"ID": strconv.Itoa(command.Song)}
+	case "requestbestmatch":
+		body = map[string]string{"Search": command.Search}
+	}
+	data, _ := json.Marshal(body)
+	ctx, cancel := context.WithTimeout(r.Context(), wsWriteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/ws/"+command.Type+"?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		clog.Error("wsServeCommand", "Unable to build the command request.", err)
+		return wsMessage{Type: "error", ID: command.ID, Error: "internal error"}
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.Header = r.Header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := &wsResponseWriter{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(rec, req)
+	reply := wsMessage{Type: "response", ID: command.ID, Status: rec.status, Headers: make(map[string]string)}
+	for key := range rec.header {
+		reply.Headers[key] = rec.header.Get(key)
+	}
+	if rec.body.Len() > 0 && json.Valid(rec.body.Bytes()) {
+		reply.Body = json.RawMessage(rec.body.Bytes())
+	}
+	return reply
+}
+
+// Collects the response of a command's handler.
+type wsResponseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+}
+
+func (w *wsResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(b)
+}
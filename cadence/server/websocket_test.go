@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connects to a station's WebSocket through the server's routes.
+func dialWebSocket(t *testing.T, s *Server, path string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(s.routes())
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func readWebSocket(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	var m wsMessage
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatalf("read from WebSocket: %v", err)
+	}
+	return m
+}
+
+func TestWebSocket(t *testing.T) {
+	s, _, fakeIC := newTestServer(t)
+	st := s.defaultStation()
+	var prev RadioInfo
+	fakeIC.SetPlaying("Song", "Artist", 2)
+	s.icecastCheck(st, &prev)
+
+	conn := dialWebSocket(t, s, "/api/ws?events=nowplaying,history")
+	m := readWebSocket(t, conn)
+	data, _ := json.Marshal(m.Data)
+	var now NowPlaying
+	if err := json.Unmarshal(data, &now); err != nil || m.Type != "event" || m.Event != "nowplaying" || now.Song.Title != "Song" {
+		t.Fatalf("first message is %+v, %v", m, err)
+	}
+
+	// Commands are answered as their HTTP routes would answer them.
+	conn.WriteJSON(wsCommand{Type: "search", ID: "1", Search: "year:abc"})
+	if m = readWebSocket(t, conn); m.Type != "response" || m.ID != "1" || m.Status != http.StatusBadRequest {
+		t.Errorf("invalid search was answered with %+v", m)
+	}
+	conn.WriteJSON(wsCommand{Type: "skip", ID: "2"})
+	if m = readWebSocket(t, conn); m.Type != "error" || m.ID != "2" {
+		t.Errorf("unknown command was answered with %+v", m)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if m = readWebSocket(t, conn); m.Type != "error" {
+		t.Errorf("malformed command was answered with %+v", m)
+	}
+
+	st.SSE.SendEventMessage("4", "listeners")
+	st.SSE.SendEventMessage("update", "history")
+	if m = readWebSocket(t, conn); m.Event != "history" || m.Data != "update" || m.ID == "" {
+		t.Errorf("filtered client received %+v", m)
+	}
+}
+
+// Browsers may connect from pages on the host they reach Cadence by, but not from other sites.
+func TestWebSocketOrigin(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	server := httptest.NewServer(s.routes())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+	for origin, want := range map[string]int{
+		server.URL:                  http.StatusSwitchingProtocols,
+		"https://elsewhere.example": http.StatusForbidden,
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != want {
+			t.Errorf("connecting from %s returned %v, %v, want %d", origin, resp, err, want)
+		}
+	}
+}